@@ -0,0 +1,70 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptedEncodings parses an Accept-Encoding header into the quality
+// of each encoding.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		accepted[name] = quality
+	}
+	return accepted
+}
+
+func encodingQuality(accepted map[string]float64, encoding string) float64 {
+	if q, ok := accepted[encoding]; ok {
+		return q
+	}
+	return accepted["*"]
+}
+
+// AcceptsEncoding reports whether an Accept-Encoding header allows
+// the encoding.
+func AcceptsEncoding(header string, encoding string) bool {
+	return encodingQuality(acceptedEncodings(header), encoding) > 0
+}
+
+// NegotiateEncoding returns the supported encoding preferred by an
+// Accept-Encoding header. Ties are decided by the order of supported.
+// It returns "" if none is accepted.
+func NegotiateEncoding(header string, supported ...string) string {
+	accepted := acceptedEncodings(header)
+	best, quality := "", 0.0
+	for _, encoding := range supported {
+		if q := encodingQuality(accepted, encoding); q > quality {
+			best, quality = encoding, q
+		}
+	}
+	return best
+}
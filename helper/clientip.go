@@ -0,0 +1,131 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helper
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetworks - Parse a list of CIDRs, single addresses are
+// treated as /32 or /128 networks.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range list {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// InNetworks checks whether ip is part of one of the networks.
+func InNetworks(networks []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedAddr strips quotes, brackets and ports of a node
+// as used by Forwarded and X-Forwarded-For.
+func forwardedAddr(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			node = node[1:end]
+		}
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// forwardedChain returns the client addresses passed by proxies,
+// the nearest proxy last. Forwarded (RFC 7239) is preferred over
+// X-Forwarded-For and X-Real-IP.
+func forwardedChain(header http.Header) []string {
+	chain := []string{}
+	if values := header["Forwarded"]; len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			addr := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.ToLower(kv[0]) == "for" {
+					addr = forwardedAddr(kv[1])
+				}
+			}
+			chain = append(chain, addr)
+		}
+		return chain
+	}
+	if values := header["X-Forwarded-For"]; len(values) > 0 {
+		for _, node := range strings.Split(strings.Join(values, ","), ",") {
+			chain = append(chain, forwardedAddr(node))
+		}
+		return chain
+	}
+	if value := header.Get("X-Real-Ip"); value != "" {
+		chain = append(chain, forwardedAddr(value))
+	}
+	return chain
+}
+
+// ClientIP - Address of the client. Forwarding headers are only
+// evaluated if the peer is a trusted proxy, then the chain is walked
+// back to the first address which isn't a trusted proxy.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(r.RemoteAddr)
+	}
+	if !InNetworks(trusted, ip) {
+		return ip
+	}
+	chain := forwardedChain(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == "" {
+			break
+		}
+		ip = chain[i]
+		if !InNetworks(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/bkaradzic/go-lz4"
+	"github.com/golang/snappy"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codecMagic starts each value written by Zip, followed by the id of
+// its codec. Values without it were written before and are decoded
+// with LEGACY_COMPRESSION. No valid legacy value starts with it: gzip
+// starts with 0x1f, json with "{" and snappy wouldn't accept "u" as
+// its first tag.
+const codecMagic = "\xffmuh"
+
+// ErrUnknownCodec is returned for values of a codec which isn't supported.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// defaultLevel selects the default level of a codec.
+const defaultLevel = -1
+
+// codec - A compression format of stored values. Levels are passed
+// within minLevel and maxLevel, or as defaultLevel. Codecs without
+// levels leave both 0.
+type codec struct {
+	id       byte
+	name     string
+	encode   func(data []byte, level int) ([]byte, error)
+	decode   func([]byte) ([]byte, error)
+	minLevel int
+	maxLevel int
+}
+
+var codecs = []codec{
+	{id: 'n', name: "none", encode: identity, decode: decodeIdentity},
+	{id: 'g', name: "gzip", encode: gzipEncode, decode: gzipDecode, minLevel: 1, maxLevel: 9},
+	{id: 's', name: "snappy", encode: snappyEncode, decode: snappyDecode},
+	{id: 'z', name: "zstd", encode: zstdEncode, decode: zstdDecode, minLevel: 1, maxLevel: 22},
+	{id: 'l', name: "lz4", encode: lz4Encode, decode: lz4Decode},
+	{id: 'b', name: "brotli", encode: brotliEncode, decode: brotliDecode, minLevel: 0, maxLevel: 11},
+}
+
+// codecByName returns a codec, unknown names select none.
+func codecByName(name string) codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return codecs[0]
+}
+
+func codecByID(id byte) (codec, error) {
+	for _, c := range codecs {
+		if c.id == id {
+			return c, nil
+		}
+	}
+	return codec{}, ErrUnknownCodec
+}
+
+func identity(data []byte, level int) ([]byte, error) {
+	return data, nil
+}
+
+func decodeIdentity(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func gzipEncode(data []byte, level int) ([]byte, error) {
+	if level == defaultLevel {
+		level = gzip.DefaultCompression
+	}
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func gzipDecode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func snappyEncode(data []byte, level int) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func snappyDecode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+func lz4Encode(data []byte, level int) ([]byte, error) {
+	return lz4.Encode(nil, data)
+}
+
+func lz4Decode(data []byte) ([]byte, error) {
+	return lz4.Decode(nil, data)
+}
+
+func brotliEncode(data []byte, level int) ([]byte, error) {
+	if level == defaultLevel {
+		level = brotli.DefaultCompression
+	}
+	var b bytes.Buffer
+	w := brotli.NewWriterLevel(&b, level)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func brotliDecode(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+}
+
+// level returns COMPRESSION_LEVEL, clamped to the range of the codec:
+// gzip 1-9, zstd 1-22 and brotli 0-11. Unset, it selects the default.
+func (c codec) level() int {
+	level, err := strconv.Atoi(os.Getenv("COMPRESSION_LEVEL"))
+	if err != nil || c.maxLevel == 0 {
+		return defaultLevel
+	}
+	if level < c.minLevel {
+		return c.minLevel
+	}
+	if level > c.maxLevel {
+		return c.maxLevel
+	}
+	return level
+}
+
+// autoCodec selects the codec of COMPRESSION=auto. Values smaller
+// than COMPRESSION_MIN_BYTES (default 256) are stored uncompressed,
+// others by COMPRESSION_AUTO (default zstd).
+func autoCodec(size int) codec {
+	min, err := strconv.Atoi(os.Getenv("COMPRESSION_MIN_BYTES"))
+	if err != nil {
+		min = 256
+	}
+	if size < min {
+		return codecs[0]
+	}
+	name := os.Getenv("COMPRESSION_AUTO")
+	if name == "" || name == "auto" {
+		name = "zstd"
+	}
+	return codecByName(name)
+}
+
+// measureEncode compresses data by the codec and records its metrics.
+func (c codec) measureEncode(data []byte, level int) ([]byte, error) {
+	start := time.Now()
+	encoded, err := c.encode(data, level)
+	if err == nil {
+		recordEncode(c.name, len(data), len(encoded), time.Since(start))
+	}
+	return encoded, err
+}
+
+func (c codec) measureDecode(data []byte) ([]byte, error) {
+	start := time.Now()
+	decoded, err := c.decode(data)
+	if err == nil {
+		recordDecode(c.name, time.Since(start))
+	}
+	return decoded, err
+}
+
+// sample compresses data by all other codecs, only to compare their
+// metrics. COMPRESSION_SAMPLE sets the share of sampled values.
+func sample(data []byte, used codec) {
+	rate, _ := strconv.ParseFloat(os.Getenv("COMPRESSION_SAMPLE"), 64)
+	if rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+	for _, c := range codecs {
+		if c.id == used.id || c.id == 'n' {
+			continue
+		}
+		if encoded, err := c.measureEncode(data, c.level()); err == nil {
+			c.measureDecode(encoded)
+		}
+	}
+}
+
+// HTTPEncoding returns the Content-Encoding of a blob written by Zip,
+// if HTTP clients are able to decode its codec, and its compressed bytes.
+func HTTPEncoding(blob string) (string, string) {
+	if !strings.HasPrefix(blob, codecMagic) || len(blob) <= len(codecMagic) {
+		return "", ""
+	}
+	payload := blob[len(codecMagic)+1:]
+	switch blob[len(codecMagic)] {
+	case 'g':
+		return "gzip", payload
+	case 'b':
+		return "br", payload
+	}
+	return "", ""
+}
+
+/*
+Zip - Generic compression layer.
+It provides supports multiple compression layers
+ * gzip
+ * snappy
+ * zstd
+ * lz4
+ * brotli
+ * auto - skips tiny and incompressible values
+ * uncompress (empty - default)
+This option should be set by system environment var "COMPRESSION".
+The codec is stored along with the value, so it may be changed later.
+*/
+func Zip(str string) string {
+	data := []byte(str)
+	name := os.Getenv("COMPRESSION")
+	c := codecByName(name)
+	if name == "auto" {
+		c = autoCodec(len(data))
+	}
+	encoded, err := c.measureEncode(data, c.level())
+	if err != nil || (name == "auto" && len(encoded) >= len(data)) {
+		c = codecs[0]
+		encoded = data
+	}
+	sample(data, c)
+	return codecMagic + string(c.id) + string(encoded)
+}
+
+// Unzip - reverse method to Zip(). Values without codec are decoded
+// by LEGACY_COMPRESSION, which defaults to COMPRESSION.
+func Unzip(str string) (string, error) {
+	if strings.HasPrefix(str, codecMagic) && len(str) > len(codecMagic) {
+		c, err := codecByID(str[len(codecMagic)])
+		if err != nil {
+			return "", err
+		}
+		decoded, err := c.measureDecode([]byte(str[len(codecMagic)+1:]))
+		return string(decoded), err
+	}
+	legacy := os.Getenv("COMPRESSION")
+	if name, ok := os.LookupEnv("LEGACY_COMPRESSION"); ok {
+		legacy = name
+	}
+	decoded, err := codecByName(legacy).decode([]byte(str))
+	return string(decoded), err
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"sync"
+	"time"
+)
+
+// codecMetrics - Counters of one codec since start
+type codecMetrics struct {
+	encoded    int64
+	decoded    int64
+	bytesIn    int64
+	bytesOut   int64
+	encodeTime time.Duration
+	decodeTime time.Duration
+}
+
+var codecStats = struct {
+	sync.Mutex
+	codecs map[string]*codecMetrics
+}{codecs: map[string]*codecMetrics{}}
+
+func metricsOf(name string) *codecMetrics {
+	m, ok := codecStats.codecs[name]
+	if !ok {
+		m = &codecMetrics{}
+		codecStats.codecs[name] = m
+	}
+	return m
+}
+
+func recordEncode(name string, in int, out int, took time.Duration) {
+	codecStats.Lock()
+	defer codecStats.Unlock()
+	m := metricsOf(name)
+	m.encoded++
+	m.bytesIn += int64(in)
+	m.bytesOut += int64(out)
+	m.encodeTime += took
+}
+
+func recordDecode(name string, took time.Duration) {
+	codecStats.Lock()
+	defer codecStats.Unlock()
+	m := metricsOf(name)
+	m.decoded++
+	m.decodeTime += took
+}
+
+func average(total time.Duration, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count) / float64(time.Microsecond)
+}
+
+// CodecStats returns per codec the values encoded and decoded by this
+// instance, the bytes before and after encoding, their ratio and the
+// average latency in microseconds.
+func CodecStats() map[string]map[string]interface{} {
+	codecStats.Lock()
+	defer codecStats.Unlock()
+	stats := map[string]map[string]interface{}{}
+	for name, m := range codecStats.codecs {
+		ratio := 0.0
+		if m.bytesIn > 0 {
+			ratio = float64(m.bytesOut) / float64(m.bytesIn)
+		}
+		stats[name] = map[string]interface{}{
+			"encoded":   m.encoded,
+			"decoded":   m.decoded,
+			"bytes_in":  m.bytesIn,
+			"bytes_out": m.bytesOut,
+			"ratio":     ratio,
+			"encode_us": average(m.encodeTime, m.encoded),
+			"decode_us": average(m.decodeTime, m.decoded),
+		}
+	}
+	return stats
+}
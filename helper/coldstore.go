@@ -0,0 +1,134 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+)
+
+// ColdStore - Storage for values offloaded from redis. Keys missing
+// in it are reported by ErrNotFound.
+type ColdStore interface {
+	Set(key, value string) error
+	Get(key string) (string, error)
+	Del(key string) error
+	Keys(prefix string) ([]string, error)
+	// CompareAndSet sets the value only if the key still holds old.
+	CompareAndSet(key, old, value string) (bool, error)
+	Close() error
+}
+
+// Cold is the cold storage in use, set once it is opened.
+var Cold ColdStore
+
+// ErrColdUnavailable is returned while the cold storage isn't opened yet.
+var ErrColdUnavailable = errors.New("cold storage not available")
+
+// OpenColdStore opens one of the cold storage backends:
+//  * bolt - a local BoltDB file (default)
+//  * dir - one file per key below a directory, e.g. a shared mount
+//  * sqlite - a SQLite database
+func OpenColdStore(backend, path string) (ColdStore, error) {
+	switch backend {
+	case "", "bolt":
+		return openBoltStore(path)
+	case "dir":
+		return openDirStore(path)
+	case "sqlite":
+		return openSQLiteStore(path)
+	}
+	return nil, errors.New("unknown cold storage " + backend)
+}
+
+// ColdSet - Set key value in the cold storage
+func ColdSet(key, value string) error {
+	if Cold == nil {
+		return ErrColdUnavailable
+	}
+	return Cold.Set(key, value)
+}
+
+// ColdGet - Fetch key from the cold storage
+func ColdGet(key string) (string, error) {
+	if Cold == nil {
+		return "", ErrColdUnavailable
+	}
+	return Cold.Get(key)
+}
+
+// ColdDel - Delete a key from the cold storage
+func ColdDel(key string) error {
+	if Cold == nil {
+		return ErrColdUnavailable
+	}
+	return Cold.Del(key)
+}
+
+// ColdCompareAndSet - Set key value in the cold storage, if it still
+// holds old. Keys deleted meanwhile aren't written again.
+func ColdCompareAndSet(key, old, value string) (bool, error) {
+	if Cold == nil {
+		return false, ErrColdUnavailable
+	}
+	return Cold.CompareAndSet(key, old, value)
+}
+
+// ColdKeys - List the keys of the cold storage starting with prefix
+func ColdKeys(prefix string) ([]string, error) {
+	if Cold == nil {
+		return nil, ErrColdUnavailable
+	}
+	return Cold.Keys(prefix)
+}
+
+// boltStore keeps values in the BoltDB opened as Bolt.
+type boltStore struct{}
+
+func openBoltStore(path string) (ColdStore, error) {
+	b, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	Bolt = b
+	if err := BoltInit(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return boltStore{}, nil
+}
+
+func (boltStore) Set(key, value string) error {
+	return BoltSet(key, value)
+}
+
+func (boltStore) Get(key string) (string, error) {
+	return BoltGet(key)
+}
+
+func (boltStore) Del(key string) error {
+	return BoltDel(key)
+}
+
+func (boltStore) Keys(prefix string) ([]string, error) {
+	return BoltKeys(prefix)
+}
+
+func (boltStore) CompareAndSet(key, old, value string) (bool, error) {
+	return BoltCompareAndSet(key, old, value)
+}
+
+func (boltStore) Close() error {
+	return Bolt.Close()
+}
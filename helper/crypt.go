@@ -0,0 +1,326 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"gopkg.in/redis.v3"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sealMagic marks blobs encrypted by Seal. It is followed by the length
+// of the key id, the id, the wrapped data key and the sealed blob.
+const sealMagic = "\xffenc"
+
+// FingerprintKeyID - Id of the key fingerprints are derived from, unless
+// ENCRYPTION_FINGERPRINT_KEY is set. The active key is recorded once.
+const FingerprintKeyID = "crypt::fingerprint"
+
+var (
+	// ErrUnknownKey is returned for blobs sealed by a key missing in the keyring.
+	ErrUnknownKey = errors.New("encryption key not in keyring")
+	// ErrSealedBlob is returned for sealed blobs which are truncated.
+	ErrSealedBlob = errors.New("sealed blob is corrupt")
+	// ErrFingerprintKey is returned if the key fingerprints are derived
+	// from is missing in the keyring.
+	ErrFingerprintKey = errors.New("fingerprint key not in keyring")
+)
+
+// keyring holds the master keys by id. Blobs are sealed by the active
+// one, the others are kept to open blobs sealed before a rotation.
+type keyring struct {
+	keys        map[string][]byte
+	active      string
+	fingerprint []byte
+}
+
+// keyrings caches the keyring, as long as its source didn't change.
+var keyrings = struct {
+	sync.Mutex
+	source string
+	ring   *keyring
+}{}
+
+// parseKeys reads "<id>:<base64 key>" entries, one per line or
+// separated by commas. Keys have 32 bytes, for AES-256.
+func parseKeys(ring *keyring, entries string) error {
+	scanner := bufio.NewScanner(strings.NewReader(strings.Replace(entries, ",", "\n", -1)))
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return errors.New("encryption keys are given as <id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(key) != 32 {
+			return errors.New("encryption key " + parts[0] + " isn't 32 bytes base64 encoded")
+		}
+		ring.keys[parts[0]] = key
+		if ring.active == "" {
+			ring.active = parts[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// keyringSource identifies the settings of the keyring, including the
+// modification of ENCRYPTION_KEYS_FILE.
+func keyringSource(path string) (string, error) {
+	source := os.Getenv("ENCRYPTION_KEYS") + "\x00" + path + "\x00" + os.Getenv("ENCRYPTION_KEY_ID") +
+		"\x00" + os.Getenv("ENCRYPTION_FINGERPRINT_KEY")
+	if path == "" {
+		return source, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return source + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10) +
+		"\x00" + strconv.FormatInt(info.Size(), 10), nil
+}
+
+// ReloadKeyring drops the cached keyring, it is loaded again by its
+// next use.
+func ReloadKeyring() {
+	keyrings.Lock()
+	defer keyrings.Unlock()
+	keyrings.source = ""
+	keyrings.ring = nil
+}
+
+// loadKeyring loads the keys of ENCRYPTION_KEYS and the file
+// ENCRYPTION_KEYS_FILE points to. ENCRYPTION_KEY_ID selects the key new
+// blobs are sealed by, it defaults to the first key. Without keys blobs
+// are stored unencrypted. The keyring is loaded again once the settings
+// or the file change.
+func loadKeyring() (*keyring, error) {
+	path := os.Getenv("ENCRYPTION_KEYS_FILE")
+	source, err := keyringSource(path)
+	if err != nil {
+		return nil, err
+	}
+	keyrings.Lock()
+	defer keyrings.Unlock()
+	if keyrings.ring != nil && keyrings.source == source {
+		return keyrings.ring, nil
+	}
+	ring := &keyring{keys: map[string][]byte{}}
+	if path != "" {
+		entries, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseKeys(ring, string(entries)); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseKeys(ring, os.Getenv("ENCRYPTION_KEYS")); err != nil {
+		return nil, err
+	}
+	if id := os.Getenv("ENCRYPTION_KEY_ID"); id != "" {
+		if _, ok := ring.keys[id]; !ok {
+			return nil, ErrUnknownKey
+		}
+		ring.active = id
+	}
+	if encoded := os.Getenv("ENCRYPTION_FINGERPRINT_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("fingerprint key isn't 32 bytes base64 encoded")
+		}
+		ring.fingerprint = key
+	}
+	keyrings.source = source
+	keyrings.ring = ring
+	return ring, nil
+}
+
+// ActiveKeyID returns the id of the key new blobs are sealed by, empty
+// if encryption is disabled.
+func ActiveKeyID() (string, error) {
+	ring, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	return ring.active, nil
+}
+
+// fingerprintKey returns the key fingerprints are derived from. It is
+// ENCRYPTION_FINGERPRINT_KEY or else the key of the keyring recorded
+// by FingerprintKeyID, so fingerprints outlast rotations of the active key.
+func fingerprintKey(ring *keyring) ([]byte, error) {
+	if ring.fingerprint != nil {
+		return ring.fingerprint, nil
+	}
+	r := RedisClient()
+	id, err := r.Get(FingerprintKeyID).Result()
+	if err == redis.Nil {
+		if err = r.SetNX(FingerprintKeyID, ring.active, 0).Err(); err == nil {
+			id, err = r.Get(FingerprintKeyID).Result()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, ok := ring.keys[id]
+	if !ok {
+		return nil, ErrFingerprintKey
+	}
+	return key, nil
+}
+
+// Fingerprint returns the hex encoded HMAC-SHA256 of data, keyed by a
+// key derived from the fingerprint key. Unlike a plain hash, equal data
+// isn't revealed to those who only read the storage. It is empty if
+// encryption is disabled.
+func Fingerprint(data string) (string, error) {
+	ring, err := loadKeyring()
+	if err != nil || ring.active == "" {
+		return "", err
+	}
+	key, err := fingerprintKey(ring)
+	if err != nil {
+		return "", err
+	}
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("muh fingerprint"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data by key, the random nonce is prepended.
+func seal(key, data, additional []byte) ([]byte, error) {
+	aead, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, additional), nil
+}
+
+func open(key, sealed, additional []byte) ([]byte, error) {
+	aead, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrSealedBlob
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// Seal encrypts a blob by a random data key, which is wrapped by the
+// active key of the keyring. Without keys the blob is returned as is.
+func Seal(blob string) (string, error) {
+	ring, err := loadKeyring()
+	if err != nil || ring.active == "" {
+		return blob, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	id := []byte(ring.active)
+	wrapped, err := seal(ring.keys[ring.active], dataKey, id)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, []byte(blob), nil)
+	if err != nil {
+		return "", err
+	}
+	out := append([]byte(sealMagic), byte(len(id)))
+	out = append(out, id...)
+	out = append(out, byte(len(wrapped)))
+	out = append(out, wrapped...)
+	return string(append(out, sealed...)), nil
+}
+
+// parseSealed splits a sealed blob into key id, wrapped data key and
+// sealed data. ok is false for blobs which aren't sealed.
+func parseSealed(blob string) (id string, wrapped, sealed []byte, ok bool, err error) {
+	if !strings.HasPrefix(blob, sealMagic) {
+		return "", nil, nil, false, nil
+	}
+	rest := []byte(blob[len(sealMagic):])
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+1 {
+		return "", nil, nil, true, ErrSealedBlob
+	}
+	id = string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+	if len(rest) < 1+int(rest[0]) {
+		return "", nil, nil, true, ErrSealedBlob
+	}
+	return id, rest[1 : 1+int(rest[0])], rest[1+int(rest[0]):], true, nil
+}
+
+// SealedBy returns the id of the key a blob is sealed by, empty for
+// blobs stored unencrypted.
+func SealedBy(blob string) string {
+	id, _, _, _, _ := parseSealed(blob)
+	return id
+}
+
+// Open decrypts a blob sealed by Seal, unencrypted blobs are returned
+// as is.
+func Open(blob string) (string, error) {
+	id, wrapped, sealed, ok, err := parseSealed(blob)
+	if err != nil || !ok {
+		return blob, err
+	}
+	ring, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	key, known := ring.keys[id]
+	if !known {
+		return "", ErrUnknownKey
+	}
+	dataKey, err := open(key, wrapped, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	data, err := open(dataKey, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helper
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// DiffLine - A single line of a diff. Op is one of " ", "+" or "-".
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffHunk - A block of changes including surrounding context lines.
+type DiffHunk struct {
+	FromStart int        `json:"from_start"`
+	FromLines int        `json:"from_lines"`
+	ToStart   int        `json:"to_start"`
+	ToLines   int        `json:"to_lines"`
+	Lines     []DiffLine `json:"lines"`
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Diff - Line based diff (Myers) between two texts, grouped into hunks
+// with the given amount of context lines.
+func Diff(from, to string, context int) []DiffHunk {
+	ops := editScript(splitLines(from), splitLines(to))
+
+	// line positions (0 based) in both texts before each operation
+	fromPos := make([]int, len(ops)+1)
+	toPos := make([]int, len(ops)+1)
+	changes := []int{}
+	for i, op := range ops {
+		fromPos[i+1], toPos[i+1] = fromPos[i], toPos[i]
+		if op.Op != "+" {
+			fromPos[i+1]++
+		}
+		if op.Op != "-" {
+			toPos[i+1]++
+		}
+		if op.Op != " " {
+			changes = append(changes, i)
+		}
+	}
+
+	hunks := []DiffHunk{}
+	for i := 0; i < len(changes); {
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*context+1 {
+			j++
+		}
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j] + context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		hunk := DiffHunk{
+			FromStart: fromPos[start] + 1,
+			FromLines: fromPos[end] - fromPos[start],
+			ToStart:   toPos[start] + 1,
+			ToLines:   toPos[end] - toPos[start],
+			Lines:     ops[start:end],
+		}
+		if hunk.FromLines == 0 {
+			hunk.FromStart--
+		}
+		if hunk.ToLines == 0 {
+			hunk.ToStart--
+		}
+		hunks = append(hunks, hunk)
+		i = j + 1
+	}
+	return hunks
+}
+
+// UnifiedDiff - Render hunks in unified diff format.
+func UnifiedDiff(fromName, toName string, hunks []DiffHunk) string {
+	var out bytes.Buffer
+	if len(hunks) == 0 {
+		return ""
+	}
+	out.WriteString("--- " + fromName + "\n+++ " + toName + "\n")
+	for _, hunk := range hunks {
+		out.WriteString("@@ -" + hunkRange(hunk.FromStart, hunk.FromLines) +
+			" +" + hunkRange(hunk.ToStart, hunk.ToLines) + " @@\n")
+		for _, line := range hunk.Lines {
+			out.WriteString(line.Op + line.Text + "\n")
+		}
+	}
+	return out.String()
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(lines)
+}
+
+// maxEdits limits the edit distance searched for, as the trace grows
+// quadratically. Larger differences are reported as full replacement.
+const maxEdits = 2000
+
+// editScript calculates the shortest edit script by using the
+// greedy algorithm of Eugene W. Myers.
+func editScript(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+	found := false
+
+	for d := 0; d <= max && d <= maxEdits && !found; d++ {
+		// keep the diagonals -d-1 ... d+1 for backtracking
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	ops := []DiffLine{}
+	if !found {
+		for _, line := range a {
+			ops = append(ops, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range b {
+			ops = append(ops, DiffLine{Op: "+", Text: line})
+		}
+		return ops
+	}
+
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		diagonal := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && diagonal(k-1) < diagonal(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := diagonal(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, DiffLine{Op: " ", Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, DiffLine{Op: "+", Text: b[prevY]})
+			} else {
+				ops = append(ops, DiffLine{Op: "-", Text: a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrColdLocked is returned if a key of the cold storage stays locked
+// by another writer.
+var ErrColdLocked = errors.New("cold storage key is locked")
+
+const (
+	dirLockTimeout = 30 * time.Second
+	dirLockRetries = 500
+	dirLockDelay   = 10 * time.Millisecond
+)
+
+// dirStore keeps each value in a file below a directory. Segments of
+// a key become directories, e.g. "snippets::<id>" is stored as
+// "snippets/<id>". The layout matches the keys of an object store, the
+// directory might be shared by several instances.
+type dirStore struct {
+	root string
+}
+
+func openDirStore(root string) (ColdStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return dirStore{root: root}, nil
+}
+
+// path maps a key to its file, escaped segments can't leave the root.
+func (d dirStore) path(key string) string {
+	segments := strings.Split(key, "::")
+	for i, segment := range segments {
+		segments[i] = url.QueryEscape(segment)
+		if segments[i] == "." || segments[i] == ".." || segments[i] == "" {
+			segments[i] = "%" + segments[i]
+		}
+	}
+	return filepath.Join(append([]string{d.root}, segments...)...)
+}
+
+// lock creates the lock file of a key, writers of all instances sharing
+// the directory wait for it. Locks older than dirLockTimeout are stale.
+func (d dirStore) lock(path string) (func(), error) {
+	lock := filepath.Join(filepath.Dir(path), ".lock"+filepath.Base(path))
+	for i := 0; i < dirLockRetries; i++ {
+		file, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > dirLockTimeout {
+			os.Remove(lock)
+			continue
+		}
+		time.Sleep(dirLockDelay)
+	}
+	return nil, ErrColdLocked
+}
+
+// Set writes into a temporary file first, readers never see partial values.
+func (d dirStore) Set(key, value string) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	unlock, err := d.lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.write(path, value)
+}
+
+// CompareAndSet holds the lock of the key while comparing and writing.
+func (d dirStore) CompareAndSet(key, old, value string) (bool, error) {
+	path := d.path(key)
+	unlock, err := d.lock(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && string(current) != old) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, d.write(path, value)
+}
+
+func (d dirStore) write(path, value string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d dirStore) Get(key string) (string, error) {
+	value, err := ioutil.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	return string(value), err
+}
+
+func (d dirStore) Del(key string) error {
+	path := d.path(key)
+	unlock, err := d.lock(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Keys walks the directory and maps the files back to their keys.
+// Temporary and lock files of running writes are skipped.
+func (d dirStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(d.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp") || strings.HasPrefix(info.Name(), ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(rel, string(filepath.Separator))
+		for i, segment := range segments {
+			switch segment {
+			case "%", "%.", "%..":
+				segments[i] = segment[1:]
+				continue
+			}
+			if segments[i], err = url.QueryUnescape(segment); err != nil {
+				return err
+			}
+		}
+		if key := strings.Join(segments, "::"); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d dirStore) Close() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helper
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var keywords = map[string]string{
+	"c":          "break case char const continue default do double else enum extern float for goto if int long return short signed sizeof static struct switch typedef union unsigned void while",
+	"go":         "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false",
+	"java":       "abstract boolean break case catch class continue default do else extends final finally for if implements import instanceof int interface new null package private protected public return static super switch this throw throws try void while",
+	"javascript": "async await break case catch class const continue default delete do else export extends false finally for function if import in instanceof let new null return switch this throw true try typeof undefined var void while yield",
+	"php":        "abstract array as break case catch class const continue default do echo else elseif extends false final for foreach function if implements interface namespace new null private protected public return static switch this throw true try use while",
+	"python":     "and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return self True try while with yield",
+	"ruby":       "alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield",
+	"rust":       "as async await break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while",
+	"shell":      "case do done elif else esac export fi for function if in local return then until while",
+	"sql":        "ALTER AND AS BY CREATE DELETE DROP FROM GROUP HAVING IN INDEX INSERT INTO JOIN LEFT LIMIT NOT NULL ON OR ORDER SELECT SET TABLE UPDATE VALUES WHERE",
+}
+
+var comments = map[string]string{
+	"c":          `//[^\n]*|/\*[\s\S]*?\*/`,
+	"cpp":        `//[^\n]*|/\*[\s\S]*?\*/`,
+	"csharp":     `//[^\n]*|/\*[\s\S]*?\*/`,
+	"css":        `/\*[\s\S]*?\*/`,
+	"go":         `//[^\n]*|/\*[\s\S]*?\*/`,
+	"java":       `//[^\n]*|/\*[\s\S]*?\*/`,
+	"javascript": `//[^\n]*|/\*[\s\S]*?\*/`,
+	"kotlin":     `//[^\n]*|/\*[\s\S]*?\*/`,
+	"php":        `//[^\n]*|#[^\n]*|/\*[\s\S]*?\*/`,
+	"rust":       `//[^\n]*|/\*[\s\S]*?\*/`,
+	"swift":      `//[^\n]*|/\*[\s\S]*?\*/`,
+	"typescript": `//[^\n]*|/\*[\s\S]*?\*/`,
+	"dockerfile": `#[^\n]*`,
+	"makefile":   `#[^\n]*`,
+	"perl":       `#[^\n]*`,
+	"python":     `#[^\n]*`,
+	"ruby":       `#[^\n]*`,
+	"shell":      `#[^\n]*`,
+	"toml":       `#[^\n]*`,
+	"yaml":       `#[^\n]*`,
+	"lua":        `--[^\n]*`,
+	"sql":        `--[^\n]*`,
+}
+
+const (
+	stringPattern = "\"(?:[^\"\\\\\\n]|\\\\.)*\"|'(?:[^'\\\\\\n]|\\\\.)*'|`[^`]*`"
+	numberPattern = `\b\d+(?:\.\d+)?\b`
+)
+
+var tokenClasses = []string{"", "muh-comment", "muh-string", "muh-number", "muh-keyword"}
+
+var highlighters = map[string]*regexp.Regexp{}
+
+func init() {
+	langs := map[string]bool{}
+	for lang := range keywords {
+		langs[lang] = true
+	}
+	for lang := range comments {
+		langs[lang] = true
+	}
+	never := `[^\x00-\x{10FFFF}]`
+	for lang := range langs {
+		comment := comments[lang]
+		if comment == "" {
+			comment = never
+		}
+		keyword := never
+		if kw := keywords[lang]; kw != "" {
+			keyword = `\b(?:` + strings.Join(strings.Fields(kw), "|") + `)\b`
+		}
+		if lang == "sql" {
+			keyword = "(?i:" + keyword + ")"
+		}
+		highlighters[lang] = regexp.MustCompile(
+			"(" + comment + ")|(" + stringPattern + ")|(" + numberPattern + ")|(" + keyword + ")",
+		)
+	}
+}
+
+// Highlight - Render a paste as HTML, wrapping comments, strings, numbers
+// and keywords into spans with "muh-*" classes. Unknown languages are only
+// escaped.
+func Highlight(lang, paste string) string {
+	expr, ok := highlighters[lang]
+	if !ok {
+		return html.EscapeString(paste)
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, m := range expr.FindAllStringSubmatchIndex(paste, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		out.WriteString(html.EscapeString(paste[last:m[0]]))
+		for group := 1; group < len(tokenClasses); group++ {
+			if m[2*group] >= 0 {
+				out.WriteString(`<span class="` + tokenClasses[group] + `">`)
+				out.WriteString(html.EscapeString(paste[m[0]:m[1]]))
+				out.WriteString(`</span>`)
+				break
+			}
+		}
+		last = m[1]
+	}
+	out.WriteString(html.EscapeString(paste[last:]))
+	return out.String()
+}
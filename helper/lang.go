@@ -0,0 +1,247 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helper
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var extensions = map[string]string{
+	".c":     "c",
+	".h":     "c",
+	".cc":    "cpp",
+	".cpp":   "cpp",
+	".hpp":   "cpp",
+	".cs":    "csharp",
+	".css":   "css",
+	".go":    "go",
+	".html":  "html",
+	".htm":   "html",
+	".java":  "java",
+	".js":    "javascript",
+	".json":  "json",
+	".kt":    "kotlin",
+	".lua":   "lua",
+	".md":    "markdown",
+	".php":   "php",
+	".pl":    "perl",
+	".py":    "python",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".sh":    "shell",
+	".bash":  "shell",
+	".sql":   "sql",
+	".swift": "swift",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".xml":   "xml",
+	".yml":   "yaml",
+	".yaml":  "yaml",
+}
+
+var filenames = map[string]string{
+	"makefile":    "makefile",
+	"dockerfile":  "dockerfile",
+	"gemfile":     "ruby",
+	"rakefile":    "ruby",
+	"vagrantfile": "ruby",
+}
+
+var interpreters = map[string]string{
+	"bash":    "shell",
+	"sh":      "shell",
+	"zsh":     "shell",
+	"python":  "python",
+	"python2": "python",
+	"python3": "python",
+	"ruby":    "ruby",
+	"node":    "javascript",
+	"perl":    "perl",
+	"php":     "php",
+	"lua":     "lua",
+}
+
+var (
+	vimModeline   = regexp.MustCompile(`(?m)\bvim?:.*\b(?:ft|filetype|syntax)=([\w+-]+)`)
+	emacsModeline = regexp.MustCompile(`-\*-.*\bmode:\s*([\w+-]+).*-\*-`)
+	emacsShort    = regexp.MustCompile(`-\*-\s*([\w+-]+)\s*-\*-`)
+)
+
+type heuristic struct {
+	lang   string
+	weight int
+	expr   *regexp.Regexp
+}
+
+var heuristics = []heuristic{
+	{"go", 3, regexp.MustCompile(`(?m)^package \w+$`)},
+	{"go", 2, regexp.MustCompile(`(?m)^func (\(\w+ \*?\w+\) )?\w+\(`)},
+	{"go", 1, regexp.MustCompile(`\w+ := `)},
+	{"go", 1, regexp.MustCompile(`\bfmt\.\w+\(`)},
+	{"python", 2, regexp.MustCompile(`(?m)^\s*def \w+\(.*\):\s*$`)},
+	{"python", 2, regexp.MustCompile(`(?m)^from [\w.]+ import `)},
+	{"python", 1, regexp.MustCompile(`(?m)^import \w+$`)},
+	{"python", 1, regexp.MustCompile(`\bself\.\w+`)},
+	{"python", 1, regexp.MustCompile(`(?m)^\s*(elif|except)\b.*:\s*$`)},
+	{"ruby", 2, regexp.MustCompile(`(?m)^\s*def \w+[?!]?(\(.*\))?\s*$`)},
+	{"ruby", 1, regexp.MustCompile(`(?m)^\s*end\s*$`)},
+	{"ruby", 2, regexp.MustCompile(`\.each(_with_index)? do\b`)},
+	{"ruby", 1, regexp.MustCompile(`(?m)^\s*(puts|require|attr_accessor) `)},
+	{"javascript", 2, regexp.MustCompile(`\bconsole\.log\(`)},
+	{"javascript", 1, regexp.MustCompile(`\b(const|let|var) \w+ = `)},
+	{"javascript", 1, regexp.MustCompile(`\bfunction\s*\w*\(`)},
+	{"javascript", 1, regexp.MustCompile(`\)\s*=>\s*\{`)},
+	{"php", 5, regexp.MustCompile(`<\?php`)},
+	{"html", 3, regexp.MustCompile(`(?i)<!DOCTYPE html|<html[\s>]`)},
+	{"html", 1, regexp.MustCompile(`(?i)</(div|span|p|body|head)>`)},
+	{"c", 3, regexp.MustCompile(`(?m)^#include [<"]`)},
+	{"c", 2, regexp.MustCompile(`\bint main\(`)},
+	{"java", 3, regexp.MustCompile(`\bpublic (static |final )*class \w+`)},
+	{"java", 2, regexp.MustCompile(`\bSystem\.out\.print`)},
+	{"rust", 3, regexp.MustCompile(`(?m)^\s*(pub )?fn \w+.*\{`)},
+	{"rust", 2, regexp.MustCompile(`\blet mut \w+`)},
+	{"rust", 1, regexp.MustCompile(`\bprintln!\(`)},
+	{"shell", 1, regexp.MustCompile(`(?m)^\s*(echo|export|fi|done|esac)\b`)},
+	{"shell", 1, regexp.MustCompile(`(?m)^\s*if \[`)},
+	{"sql", 3, regexp.MustCompile(`(?im)^\s*(select .+ from|insert into|update \w+ set|create table)\b`)},
+	{"css", 2, regexp.MustCompile(`(?m)^[.#]?[\w-]+(\s*[,>]\s*[.#]?[\w-]+)*\s*\{\s*$`)},
+	{"css", 1, regexp.MustCompile(`(?m)^\s+[\w-]+:\s*[^;]+;\s*$`)},
+	{"yaml", 1, regexp.MustCompile(`(?m)^---\s*$`)},
+	{"yaml", 1, regexp.MustCompile(`(?m)^[\w-]+:(\s+[^{;]*)?$`)},
+}
+
+// DetectLanguage - Guess the language of a paste by checking editor
+// modelines, the shebang line, the filename and finally some content
+// heuristics. It returns the language and a confidence between 0 and 1,
+// or an empty language if nothing matched.
+func DetectLanguage(filename, paste string) (string, float64) {
+	if lang := detectByModeline(paste); lang != "" {
+		return lang, 1
+	}
+	if lang := detectByShebang(paste); lang != "" {
+		return lang, 0.95
+	}
+	if lang := detectByFilename(filename); lang != "" {
+		return lang, 0.9
+	}
+	return detectByContent(paste)
+}
+
+func detectByModeline(paste string) string {
+	head, tail := paste, paste
+	if len(paste) > 512 {
+		head, tail = paste[:512], paste[len(paste)-512:]
+	}
+	for _, part := range []string{head, tail} {
+		if m := vimModeline.FindStringSubmatch(part); m != nil {
+			return normalizeLanguage(m[1])
+		}
+		if m := emacsModeline.FindStringSubmatch(part); m != nil {
+			return normalizeLanguage(m[1])
+		}
+		if m := emacsShort.FindStringSubmatch(part); m != nil {
+			return normalizeLanguage(m[1])
+		}
+	}
+	return ""
+}
+
+func detectByShebang(paste string) string {
+	if !strings.HasPrefix(paste, "#!") {
+		return ""
+	}
+	line := strings.SplitN(paste, "\n", 2)[0]
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+	if lang, ok := interpreters[interpreter]; ok {
+		return lang
+	}
+	return interpreters[strings.TrimRight(interpreter, "0123456789.")]
+}
+
+func detectByFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	base := strings.ToLower(path.Base(filename))
+	if lang, ok := filenames[base]; ok {
+		return lang
+	}
+	return extensions[path.Ext(base)]
+}
+
+func detectByContent(paste string) (string, float64) {
+	trimmed := strings.TrimSpace(paste)
+	if trimmed == "" {
+		return "", 0
+	}
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+		return "json", 0.9
+	}
+	scores := map[string]int{}
+	for _, h := range heuristics {
+		if h.expr.MatchString(paste) {
+			scores[h.lang] += h.weight
+		}
+	}
+	best, first := "", 0
+	for lang, score := range scores {
+		if score > first || (score == first && lang < best) {
+			best, first = lang, score
+		}
+	}
+	second := 0
+	for lang, score := range scores {
+		if lang != best && score > second {
+			second = score
+		}
+	}
+	if first < 2 {
+		return "", 0
+	}
+	confidence := float64(first-second) / float64(first+1)
+	if confidence > 0.8 {
+		confidence = 0.8
+	}
+	return best, confidence
+}
+
+func normalizeLanguage(name string) string {
+	name = strings.ToLower(name)
+	switch name {
+	case "sh", "bash", "zsh", "shell-script":
+		return "shell"
+	case "js":
+		return "javascript"
+	case "py":
+		return "python"
+	case "rb":
+		return "ruby"
+	case "c++":
+		return "cpp"
+	case "yml":
+		return "yaml"
+	}
+	return name
+}
@@ -16,11 +16,9 @@ package helper
 
 import (
 	"bytes"
-	"compress/gzip"
+	"errors"
 	"github.com/boltdb/bolt"
-	"github.com/golang/snappy"
 	"gopkg.in/redis.v3"
-	"io/ioutil"
 	"os"
 )
 
@@ -32,17 +30,27 @@ var Bolt *bolt.DB
 
 var redisconn *redis.Client
 
+var (
+	// ErrBoltUnavailable is returned while BoltDB isn't opened yet.
+	ErrBoltUnavailable = errors.New("bolt not available")
+	// ErrNotFound is returned for keys missing in the cold storage.
+	ErrNotFound = errors.New("key not found")
+)
+
 // BoltInit - Setup key bucket
-func BoltInit() {
-	Bolt.Update(func(tx *bolt.Tx) error {
+func BoltInit() error {
+	return Bolt.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("muh"))
 		return err
 	})
 }
 
 // BoltSet - Set key value in BoltDB
-func BoltSet(key, value string) {
-	Bolt.Update(func(tx *bolt.Tx) error {
+func BoltSet(key, value string) error {
+	if Bolt == nil {
+		return ErrBoltUnavailable
+	}
+	return Bolt.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("muh"))
 		err := b.Put([]byte(key), []byte(value))
 		return err
@@ -50,25 +58,69 @@ func BoltSet(key, value string) {
 }
 
 // BoltGet - Fetch key from BoltDB
-func BoltGet(key string) string {
+func BoltGet(key string) (string, error) {
+	if Bolt == nil {
+		return "", ErrBoltUnavailable
+	}
 	var ret string
-	Bolt.View(func(tx *bolt.Tx) error {
+	err := Bolt.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("muh"))
-		ret = string(b.Get([]byte(key)))
+		value := b.Get([]byte(key))
+		if value == nil {
+			return ErrNotFound
+		}
+		ret = string(value)
 		return nil
 	})
-	return ret
+	return ret, err
 }
 
 // BoltDel - Delete a key from BoltDB
-func BoltDel(key string) {
-	Bolt.Update(func(tx *bolt.Tx) error {
+func BoltDel(key string) error {
+	if Bolt == nil {
+		return ErrBoltUnavailable
+	}
+	return Bolt.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("muh"))
 		err := b.Delete([]byte(key))
 		return err
 	})
 }
 
+// BoltCompareAndSet - Set key value in BoltDB, if it still holds old
+func BoltCompareAndSet(key, old, value string) (bool, error) {
+	if Bolt == nil {
+		return false, ErrBoltUnavailable
+	}
+	swapped := false
+	err := Bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("muh"))
+		current := b.Get([]byte(key))
+		if current == nil || string(current) != old {
+			return nil
+		}
+		swapped = true
+		return b.Put([]byte(key), []byte(value))
+	})
+	return swapped && err == nil, err
+}
+
+// BoltKeys - List the keys of BoltDB starting with prefix
+func BoltKeys(prefix string) ([]string, error) {
+	if Bolt == nil {
+		return nil, ErrBoltUnavailable
+	}
+	var keys []string
+	err := Bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("muh")).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
 // RedisClient - Get new redis connection.
 func RedisClient() *redis.Client {
 	if redisconn == nil {
@@ -82,43 +134,3 @@ func RedisClient() *redis.Client {
 	}
 	return redisconn
 }
-
-/*
-Zip - Generic compression layer.
-It provides supports multiple compression layers
- * gzip
- * snappy
- * uncompress (empty - default)
-This option should be set by system environment var "COMPRESSION"
-*/
-func Zip(str string) string {
-	if os.Getenv("COMPRESSION") == "snappy" {
-		encoded := snappy.Encode(nil, []byte(str))
-		return string(encoded)
-	} else if os.Getenv("COMPRESSION") == "gzip" {
-		var b bytes.Buffer
-		w := gzip.NewWriter(&b)
-		w.Write([]byte(str))
-		w.Close()
-		return b.String()
-	}
-	return str
-}
-
-// Unzip - reverse method to Zip()
-func Unzip(str string) string {
-	if os.Getenv("COMPRESSION") == "snappy" {
-		decoded, _ := snappy.Decode(nil, []byte(str))
-		return string(decoded)
-	} else if os.Getenv("COMPRESSION") == "gzip" {
-		readbuf := new(bytes.Buffer)
-		readbuf.WriteString(str)
-
-		r, _ := gzip.NewReader(readbuf)
-		defer r.Close()
-		unzip, _ := ioutil.ReadAll(r)
-
-		return string(unzip)
-	}
-	return str
-}
@@ -0,0 +1,86 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// sqliteStore keeps values in a table of a SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (ColdStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS cold (key TEXT PRIMARY KEY, value BLOB NOT NULL)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqliteStore{db: db}, nil
+}
+
+func (s sqliteStore) Set(key, value string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO cold (key, value) VALUES (?, ?)", key, []byte(value))
+	return err
+}
+
+func (s sqliteStore) Get(key string) (string, error) {
+	var value []byte
+	err := s.db.QueryRow("SELECT value FROM cold WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return string(value), err
+}
+
+func (s sqliteStore) Del(key string) error {
+	_, err := s.db.Exec("DELETE FROM cold WHERE key = ?", key)
+	return err
+}
+
+func (s sqliteStore) CompareAndSet(key, old, value string) (bool, error) {
+	result, err := s.db.Exec("UPDATE cold SET value = ? WHERE key = ? AND value = ?", []byte(value), key, []byte(old))
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func (s sqliteStore) Keys(prefix string) ([]string, error) {
+	rows, err := s.db.Query("SELECT key FROM cold WHERE substr(key, 1, ?) = ?", len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s sqliteStore) Close() error {
+	return s.db.Close()
+}
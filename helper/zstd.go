@@ -0,0 +1,145 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package helper
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// zstd encoders and decoders are expensive to set up, they are kept
+// per level and dictionary.
+var zstdCoders = struct {
+	sync.Mutex
+	encoders map[string]*zstd.Encoder
+	decoders map[string]*zstd.Decoder
+	dicts    map[string][]byte
+}{
+	encoders: map[string]*zstd.Encoder{},
+	decoders: map[string]*zstd.Decoder{},
+	dicts:    map[string][]byte{},
+}
+
+// loadDictionary reads a dictionary file once.
+func loadDictionary(path string) ([]byte, error) {
+	if dict, ok := zstdCoders.dicts[path]; ok {
+		return dict, nil
+	}
+	dict, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	zstdCoders.dicts[path] = dict
+	return dict, nil
+}
+
+// zstdDictionary loads the dictionary ZSTD_DICTIONARY points to, e.g.
+// trained by "zstd --train" on typical pastes. New values are
+// compressed with it.
+func zstdDictionary() ([]byte, error) {
+	path := os.Getenv("ZSTD_DICTIONARY")
+	if path == "" {
+		return nil, nil
+	}
+	return loadDictionary(path)
+}
+
+// zstdDictionaries loads ZSTD_DICTIONARY and the comma separated
+// dictionaries of ZSTD_DICTIONARIES, which values compressed before
+// were compressed with. Frames carry the id of their dictionary, the
+// decoder picks it.
+func zstdDictionaries() ([][]byte, error) {
+	var dicts [][]byte
+	paths := append([]string{os.Getenv("ZSTD_DICTIONARY")}, strings.Split(os.Getenv("ZSTD_DICTIONARIES"), ",")...)
+	for _, path := range paths {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		dict, err := loadDictionary(path)
+		if err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, dict)
+	}
+	return dicts, nil
+}
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdCoders.Lock()
+	defer zstdCoders.Unlock()
+	dict, err := zstdDictionary()
+	if err != nil {
+		return nil, err
+	}
+	key := strconv.Itoa(level) + ":" + os.Getenv("ZSTD_DICTIONARY")
+	if encoder, ok := zstdCoders.encoders[key]; ok {
+		return encoder, nil
+	}
+	options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if level != defaultLevel {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if dict != nil {
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	zstdCoders.encoders[key] = encoder
+	return encoder, nil
+}
+
+func zstdDecoder() (*zstd.Decoder, error) {
+	zstdCoders.Lock()
+	defer zstdCoders.Unlock()
+	dicts, err := zstdDictionaries()
+	if err != nil {
+		return nil, err
+	}
+	key := os.Getenv("ZSTD_DICTIONARY") + "\x00" + os.Getenv("ZSTD_DICTIONARIES")
+	if decoder, ok := zstdCoders.decoders[key]; ok {
+		return decoder, nil
+	}
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if len(dicts) > 0 {
+		options = append(options, zstd.WithDecoderDicts(dicts...))
+	}
+	decoder, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	zstdCoders.decoders[key] = decoder
+	return decoder, nil
+}
+
+func zstdEncode(data []byte, level int) ([]byte, error) {
+	encoder, err := zstdEncoder(level)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(data, nil), nil
+}
+
+func zstdDecode(data []byte) ([]byte, error) {
+	decoder, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(data, nil)
+}
@@ -16,14 +16,35 @@ package main
 
 import "github.com/gin-gonic/gin"
 import "github.com/muhproductions/muh/v1"
+import "github.com/muhproductions/muh/v1/models"
+import "os"
+
+import log "github.com/Sirupsen/logrus"
 
 // GetEngine returns the GinEngine, which got all routes.
+// The client address is resolved before logging it, responses
+// are compressed for clients accepting it.
 func GetEngine() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(v1.RealIP(), v1.RequestID(), gin.Logger(), gin.Recovery(), v1.Compress())
 	v1.Routes(r)
 	return r
 }
 
+// rotateKeys requests the re-encryption of stored bodies by the active
+// key. Running instances do it in the background.
+func rotateKeys() {
+	rotation, err := models.RequestRotation()
+	if err != nil {
+		log.Fatal(err, "Requesting key rotation failed")
+	}
+	log.WithField("rotation", rotation).Info("Requested key rotation")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys()
+		return
+	}
 	GetEngine().Run()
 }
@@ -15,13 +15,26 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/appleboy/gofight"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/dict"
 	"github.com/muhproductions/muh/helper"
+	"github.com/muhproductions/muh/v1"
+	"github.com/muhproductions/muh/v1/models"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/redis.v3"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func conf(t *testing.T) *gofight.RequestConfig {
@@ -109,7 +122,7 @@ func TestUserCreateReturns201(t *testing.T) {
 		})
 }
 
-func TestUserReCreateReturns405(t *testing.T) {
+func TestUserReCreateReturns409(t *testing.T) {
 	conf := conf(t)
 	conf.POST("/v1/users").
 		SetFORM(gofight.H{
@@ -126,7 +139,7 @@ func TestUserReCreateReturns405(t *testing.T) {
 			"password": "pass",
 		}).
 		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, 405, r.Code, "ResponseCode should be 405")
+			assert.Equal(t, 409, r.Code, "ResponseCode should be 409")
 		})
 }
 
@@ -166,6 +179,8 @@ func TestLimitHitsReturns429(t *testing.T) {
 			}).
 			Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 				assert.Equal(t, 429, r.Code, "ResponseCode should be 429")
+				assert.NotEmpty(t, r.HeaderMap.Get("Retry-After"), "Retry-After is set")
+				assert.NotEmpty(t, r.HeaderMap.Get("X-Ratelimit-Hits-Reset"), "Reset is set")
 			})
 	}
 }
@@ -247,3 +262,1582 @@ func TestUserAuthorizeJSON(t *testing.T) {
 			assert.Equal(t, 200, r.Code, "ResponseCode should be 204")
 		})
 }
+
+func TestGistCreateDetectsLanguage(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	var fetched map[string]interface{}
+
+	conf.POST("/v1/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"#!/usr/bin/env python3\\nprint('moo')\"},{\"paste\":\"moo\",\"filename\":\"main.go\"},{\"paste\":\"puts 'moo'\",\"lang\":\"ruby\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	gist := created["gist"].(map[string]interface{})
+
+	conf.GET("/v1/gists/"+gist["uuid"].(string)).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &fetched)
+		})
+
+	langs := map[string]string{}
+	for _, snip := range fetched["snippets"].(map[string]interface{}) {
+		parsedsnippet := snip.(map[string]interface{})
+		langs[parsedsnippet["paste"].(string)] = parsedsnippet["lang"].(string)
+		if parsedsnippet["paste"] == "puts 'moo'" {
+			assert.Nil(t, parsedsnippet["lang_confidence"], "Client language is not detected")
+		} else {
+			assert.NotEmpty(t, parsedsnippet["lang_confidence"], "Detected language has a confidence")
+		}
+	}
+	assert.Equal(t, "python", langs["#!/usr/bin/env python3\nprint('moo')"], "Detected by shebang")
+	assert.Equal(t, "go", langs["moo"], "Detected by filename")
+	assert.Equal(t, "ruby", langs["puts 'moo'"], "Client language wins")
+}
+
+func TestGistEmbed(t *testing.T) {
+	defer os.Unsetenv("BASE_URL")
+	os.Setenv("BASE_URL", "http://muh.io")
+	conf := conf(t)
+	var created map[string]interface{}
+	var oembed map[string]interface{}
+
+	conf.POST("/v1/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"func moo() {} // <b>\",\"lang\":\"go\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+
+	conf.GET("/v1/gists/"+uuid+"/embed.js").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Contains(t, r.HeaderMap.Get("Content-Type"), "application/javascript")
+			assert.Contains(t, r.Body.String(), "document.write(")
+			assert.Contains(t, r.Body.String(), "muh-keyword")
+			assert.NotContains(t, r.Body.String(), "<b>", "Paste is escaped")
+		})
+
+	conf.GET("/oembed?url=http://muh.io/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &oembed)
+		})
+	assert.Equal(t, "rich", oembed["type"])
+	assert.Contains(t, oembed["html"], "/v1/gists/"+uuid+"/embed.js")
+
+	conf.GET("/oembed?url=http://muh.io/v1/gists/unknown").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, r.Code, "ResponseCode should be 404")
+		})
+
+	hostile := `x"><img src=x onerror=alert(1)>`
+	conf.POST("/v1/gists/"+url.PathEscape(hostile)).
+		SetBody(`{"snippets":[{"paste":"moo","lang":"text"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+		})
+	target := url.QueryEscape("http://muh.io/v1/gists/" + url.PathEscape(hostile))
+	conf.GET("/oembed?url="+target).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &oembed)
+		})
+	assert.NotContains(t, oembed["html"], "<img", "Gist ids are escaped")
+	assert.NotContains(t, oembed["title"], "<img", "Titles are escaped")
+	assert.Contains(t, oembed["html"], "/v1/gists/"+url.PathEscape(hostile)+"/embed.js")
+
+	request := httptest.NewRequest("GET", "/oembed?url=http://muh.io/v1/gists/"+uuid, nil)
+	request.Host = `muh.io"><script>alert(1)</script>`
+	os.Unsetenv("BASE_URL")
+	response := httptest.NewRecorder()
+	GetEngine().ServeHTTP(response, request)
+	assert.Equal(t, 400, response.Code, "Invalid Host headers are rejected")
+	assert.NotContains(t, response.Body.String(), "<script>")
+	os.Setenv("BASE_URL", "https://gists.example.com/")
+	response = httptest.NewRecorder()
+	GetEngine().ServeHTTP(response, request)
+	assert.Equal(t, 200, response.Code, "BASE_URL replaces the Host header")
+	assert.Contains(t, response.Body.String(), `"provider_url":"https://gists.example.com"`)
+	assert.NotContains(t, response.Body.String(), "alert")
+}
+
+func TestGistShortIDAndSlug(t *testing.T) {
+	conf := conf(t)
+	var user map[string]interface{}
+	var created map[string]interface{}
+	var fetched map[string]interface{}
+
+	os.Setenv("GIST_ID_LENGTH", "8")
+	defer os.Unsetenv("GIST_ID_LENGTH")
+
+	conf.POST("/v1/users").
+		SetFORM(gofight.H{
+			"username": "moo",
+			"password": "pass",
+		}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &user)
+		})
+	userid := user["user"].(map[string]interface{})["uuid"].(string)
+
+	conf.PUT("/v1/users/"+userid+"/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"mooo ruby\",\"lang\":\"ruby\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	assert.Len(t, uuid, 8, "Short gist id is used")
+
+	conf.PUT("/v1/users/unknown/gists/"+uuid+"/slug").
+		SetFORM(gofight.H{"slug": "moo-config"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, r.Code, "Only owners can set slugs")
+		})
+
+	conf.PUT("/v1/users/"+userid+"/gists/"+uuid+"/slug").
+		SetFORM(gofight.H{"slug": "Invalid Slug"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "ResponseCode should be 422")
+		})
+
+	conf.PUT("/v1/users/"+userid+"/gists/"+uuid+"/slug").
+		SetFORM(gofight.H{"slug": "moo-config"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+		})
+
+	conf.GET("/v1/gists/moo-config").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "Gist is resolvable by slug")
+			json.Unmarshal(r.Body.Bytes(), &fetched)
+		})
+	gist := fetched["gist"].(map[string]interface{})
+	assert.Equal(t, uuid, gist["uuid"])
+	assert.Equal(t, "moo-config", gist["slug"])
+
+	conf.PUT("/v1/users/"+userid+"/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"huiii go\",\"lang\":\"go\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	conf.PUT("/v1/users/"+userid+"/gists/"+created["gist"].(map[string]interface{})["uuid"].(string)+"/slug").
+		SetFORM(gofight.H{"slug": "moo-config"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 409, r.Code, "Slugs are unique")
+		})
+}
+
+func TestGistDiff(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	var fetched map[string]interface{}
+	var diff map[string]interface{}
+
+	conf.POST("/v1/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"port: 80\\nhost: moo\\n\",\"lang\":\"yaml\"},{\"paste\":\"port: 8080\\nhost: moo\\n\",\"lang\":\"yaml\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &fetched)
+		})
+	ids := map[string]string{}
+	for id, snip := range fetched["snippets"].(map[string]interface{}) {
+		ids[snip.(map[string]interface{})["paste"].(string)] = id
+	}
+	from, to := ids["port: 80\nhost: moo\n"], ids["port: 8080\nhost: moo\n"]
+
+	conf.GET("/v1/gists/"+uuid+"/diff?from="+from+"&to="+to).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &diff)
+		})
+	result := diff["diff"].(map[string]interface{})
+	assert.Len(t, result["hunks"], 1, "One hunk returned")
+	assert.Contains(t, result["unified"], "-port: 80\n+port: 8080\n host: moo\n")
+
+	conf.GET("/v1/gists/"+uuid+"/diff/"+uuid+"?from="+from+"&to="+to+"&format=text").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Contains(t, r.Body.String(), "@@ -1,2 +1,2 @@")
+		})
+
+	conf.GET("/v1/gists/"+uuid+"/diff?from="+from+"&to=unknown").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, r.Code, "ResponseCode should be 404")
+		})
+}
+
+func createUser(t *testing.T, conf *gofight.RequestConfig, name string) string {
+	var user map[string]interface{}
+	conf.POST("/v1/users").
+		SetFORM(gofight.H{
+			"username": name,
+			"password": "pass",
+		}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &user)
+		})
+	return user["user"].(map[string]interface{})["uuid"].(string)
+}
+
+func TestGistComments(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	var fetched map[string]interface{}
+	var comment map[string]interface{}
+	var comments map[string]interface{}
+
+	owner := createUser(t, conf, "moo")
+	other := createUser(t, conf, "muh")
+
+	conf.PUT("/v1/users/"+owner+"/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"a\\nb\\nc\\n\",\"lang\":\"text\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &fetched)
+		})
+	var snippet string
+	for id := range fetched["snippets"].(map[string]interface{}) {
+		snippet = id
+	}
+
+	conf.POST("/v1/gists/"+uuid+"/comments").
+		SetJSON(gofight.D{"body": "moo"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 401, r.Code, "Comments require authentication")
+		})
+
+	conf.POST("/v1/gists/"+uuid+"/comments").
+		SetHeader(gofight.H{"Authorization": "Token " + other}).
+		SetJSON(gofight.D{"body": "moo", "snippet": snippet, "line_start": 3, "line_end": 4}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "Line range must be inside the snippet")
+		})
+
+	conf.POST("/v1/gists/"+uuid+"/comments").
+		SetHeader(gofight.H{"Authorization": "Token " + other}).
+		SetJSON(gofight.D{"body": "moo", "snippet": snippet, "line_start": 2, "line_end": 3}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &comment)
+		})
+	id := comment["comment"].(map[string]interface{})["uuid"].(string)
+
+	conf.GET("/v1/gists/"+uuid+"/comments").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &comments)
+		})
+	list := comments["comments"].([]interface{})
+	assert.Len(t, list, 1, "One comment returned")
+	assert.Equal(t, other, list[0].(map[string]interface{})["author"])
+	assert.Equal(t, "2", list[0].(map[string]interface{})["line_start"])
+
+	third := createUser(t, conf, "mooh")
+	conf.DELETE("/v1/gists/"+uuid+"/comments/"+id).
+		SetHeader(gofight.H{"Authorization": "Token " + third}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 403, r.Code, "Only author or owner may delete")
+		})
+
+	conf.DELETE("/v1/gists/"+uuid+"/comments/"+id).
+		SetHeader(gofight.H{"Authorization": "Token " + owner}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "Owner may moderate comments")
+		})
+
+	conf.GET("/v1/gists/"+uuid+"/comments").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &comments)
+		})
+	assert.Len(t, comments["comments"], 0, "Comment was deleted")
+}
+
+func TestUserTagsAndCollections(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	var tagged map[string]interface{}
+	var collection map[string]interface{}
+
+	userid := createUser(t, conf, "moo")
+	conf.PUT("/v1/users/"+userid+"/gists").
+		SetBody("{\"snippets\":[{\"paste\":\"server {}\",\"lang\":\"nginx\"}]}").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+
+	conf.PUT("/v1/users/"+userid+"/gists/"+uuid+"/tags").
+		SetJSON(gofight.D{"tags": []string{"Nginx", "prod"}}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+		})
+
+	conf.PUT("/v1/users/"+userid+"/gists/"+uuid+"/tags").
+		SetJSON(gofight.D{"tags": []string{"not valid"}}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "ResponseCode should be 422")
+		})
+
+	conf.GET("/v1/users/"+userid+"/tags/nginx").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &tagged)
+		})
+	assert.Equal(t, []interface{}{uuid}, tagged["gists"], "Gist is listed by tag")
+
+	conf.DELETE("/v1/users/"+userid+"/gists/"+uuid+"/tags/nginx").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+		})
+	conf.GET("/v1/users/"+userid+"/tags").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &tagged)
+		})
+	assert.Equal(t, []interface{}{"prod"}, tagged["tags"], "Unused tags are removed")
+
+	conf.PUT("/v1/users/"+userid+"/collections").
+		SetFORM(gofight.H{"name": "configs"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &collection)
+		})
+	id := collection["collection"].(map[string]interface{})["uuid"].(string)
+
+	conf.PUT("/v1/users/"+userid+"/collections/"+id+"/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+		})
+	conf.GET("/v1/users/"+userid+"/collections/"+id).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			json.Unmarshal(r.Body.Bytes(), &collection)
+		})
+	assert.Equal(t, []interface{}{uuid}, collection["gists"], "Gist is part of the collection")
+
+	conf.GET("/v1/users/"+createUser(t, conf, "muh")+"/collections/"+id).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, r.Code, "Collections are private")
+		})
+}
+
+func TestSlidingWindow(t *testing.T) {
+	window := v1.Window{Previous: 10, Current: 0, Elapsed: 30 * time.Minute, Period: time.Hour}
+	assert.Equal(t, int64(5), window.Count(), "Previous window is weighted")
+	assert.Equal(t, 18*time.Minute, window.RetryAfter(2), "Previous window decays")
+	assert.Equal(t, time.Duration(0), window.RetryAfter(5), "Within limit")
+
+	window = v1.Window{Previous: 0, Current: 10, Elapsed: 30 * time.Minute, Period: time.Hour}
+	assert.Equal(t, time.Hour, window.RetryAfter(5), "Current window has to decay")
+
+	limiter := v1.NewMemoryLimiter()
+	limiter.Hit("moo", 3, time.Hour)
+	window, _ = limiter.Hit("moo", 2, time.Hour)
+	assert.True(t, window.Count() >= 5, "Hits are summed up")
+	window, _ = limiter.Hit("moo", 1, time.Nanosecond)
+	assert.Equal(t, int64(1), window.Current, "Windows move on")
+}
+
+func policyEngine(t *testing.T, config string, middlewares ...gin.HandlerFunc) *gin.Engine {
+	file, err := ioutil.TempFile("", "ratelimit")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(config)
+	file.Close()
+	policies, err := v1.LoadRatelimitConfig(file.Name())
+	assert.Nil(t, err, "Config is valid")
+
+	r := gin.New()
+	r.Use(append(middlewares, v1.RatelimitWith(policies))...)
+	ok := func(c *gin.Context) { c.String(200, "ok") }
+	r.GET("/free", ok)
+	r.GET("/limited/:id", ok)
+	r.POST("/limited/:id", ok)
+	r.GET("/large", func(c *gin.Context) {
+		c.String(200, strings.Repeat("a", 500))
+	})
+	r.POST("/echo", func(c *gin.Context) {
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(200, string(data))
+	})
+	return r
+}
+
+func TestRatelimitPolicies(t *testing.T) {
+	userid := createUser(t, conf(t), "moo")
+	engine := policyEngine(t, `{
+		"exempt": ["GET /free"],
+		"allow": ["10.1.0.0/16"],
+		"api_keys": {"sekret": "partner"},
+		"policies": [
+			{"name": "reads", "methods": ["GET"], "paths": ["/limited/**"], "hits": 2, "api_key": {"hits": 4}},
+			{"name": "writes", "methods": ["POST"], "hits": 1, "authenticated": {"hits": 3}}
+		]
+	}`)
+
+	codes := func(method string, path string, headers gofight.H, count int) []int {
+		result := []int{}
+		for i := 0; i < count; i++ {
+			request := gofight.New().GET(path)
+			if method == "POST" {
+				request = gofight.New().POST(path)
+			}
+			request.SetHeader(headers).
+				Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+					result = append(result, r.Code)
+				})
+		}
+		return result
+	}
+
+	assert.Equal(t, []int{200, 200, 200, 200}, codes("GET", "/free", gofight.H{}, 4), "Exempt route")
+	assert.Equal(t, []int{200, 200, 429}, codes("GET", "/limited/1", gofight.H{}, 3), "Read budget")
+	assert.Equal(t, []int{200, 200, 200, 200, 429},
+		codes("GET", "/limited/1", gofight.H{"X-Api-Key": "sekret"}, 5), "Api key budget")
+	assert.Equal(t, []int{200, 429}, codes("POST", "/limited/1", gofight.H{}, 2), "Write budget")
+	assert.Equal(t, []int{200, 200, 200, 429},
+		codes("POST", "/limited/1", gofight.H{"Authorization": "Token " + userid}, 4), "Authenticated budget")
+	assert.Equal(t, []int{429},
+		codes("POST", "/limited/1", gofight.H{"Authorization": "Token moo"}, 1), "Unknown users are anonymous")
+}
+
+func TestRatelimitHeaders(t *testing.T) {
+	conf(t)
+	engine := policyEngine(t, `{
+		"policies": [{"name": "all", "hits": 2, "bytes": 1000, "period": "10m"}]
+	}`)
+	var body map[string]interface{}
+
+	gofight.New().GET("/limited/1").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Equal(t, "2", r.HeaderMap.Get("RateLimit-Limit"), "Hits are closest to the limit")
+			assert.Equal(t, "1", r.HeaderMap.Get("RateLimit-Remaining"))
+			assert.NotEmpty(t, r.HeaderMap.Get("RateLimit-Reset"))
+			assert.Equal(t, "2;w=600, 1000;w=600", r.HeaderMap.Get("RateLimit-Policy"))
+			assert.Equal(t, "1", r.HeaderMap.Get("X-Ratelimit-Hits"), "Legacy headers are kept")
+		})
+	gofight.New().GET("/limited/1").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	gofight.New().GET("/limited/1").
+		Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 429, r.Code, "ResponseCode should be 429")
+			assert.Equal(t, "0", r.HeaderMap.Get("RateLimit-Remaining"))
+			assert.NotEmpty(t, r.HeaderMap.Get("Retry-After"))
+			json.Unmarshal(r.Body.Bytes(), &body)
+		})
+	assert.Equal(t, "ratelimited", body["code"])
+	details := body["details"].(map[string]interface{})
+	assert.Equal(t, "hits", details["budget"], "Exceeded budget is named")
+	assert.Equal(t, "all", details["policy"])
+	assert.Equal(t, float64(2), details["limit"])
+	assert.NotNil(t, details["reset"])
+	assert.NotNil(t, details["retry_after"])
+}
+
+func TestRatelimitCompressedBytes(t *testing.T) {
+	conf(t)
+	engine := policyEngine(t, `{
+		"policies": [{"name": "all", "bytes": 900, "period": "10m"}]
+	}`, v1.Compress())
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		gofight.New().GET("/large").
+			SetHeader(gofight.H{"Accept-Encoding": "gzip"}).
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				codes = append(codes, r.Code)
+			})
+	}
+	assert.Equal(t, []int{200, 200, 429}, codes, "Compressed responses count against the byte budget")
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := helper.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	assert.Nil(t, err)
+	r := gin.New()
+	r.Use(v1.RealIPWith(trusted))
+	r.GET("/ip", func(c *gin.Context) {
+		c.String(200, c.ClientIP())
+	})
+	clientIP := func(remote string, headers map[string]string) string {
+		request := httptest.NewRequest("GET", "/ip", nil)
+		request.RemoteAddr = remote
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, request)
+		return recorder.Body.String()
+	}
+
+	assert.Equal(t, "203.0.113.9", clientIP("203.0.113.9:1234", map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+		"X-Real-IP":       "1.2.3.4",
+	}), "Headers of untrusted peers are ignored")
+	assert.Equal(t, "198.51.100.7", clientIP("192.0.2.1:1234", map[string]string{
+		"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.0.0.5",
+	}), "Chain is walked back to the first untrusted hop")
+	assert.Equal(t, "198.51.100.7", clientIP("192.0.2.1:1234", map[string]string{
+		"X-Real-IP": "198.51.100.7",
+	}), "X-Real-IP is supported")
+	assert.Equal(t, "2001:db8:cafe::17", clientIP("10.1.1.1:1234", map[string]string{
+		"Forwarded":       `for=1.2.3.4, for="[2001:db8:cafe::17]:4711";proto=https`,
+		"X-Forwarded-For": "1.2.3.4",
+	}), "Forwarded is preferred")
+	assert.Equal(t, "10.1.1.1", clientIP("10.1.1.1:1234", map[string]string{
+		"Forwarded": "for=unknown",
+	}), "Unknown clients stay at the proxy")
+}
+
+func TestRatelimitTransferredBytes(t *testing.T) {
+	conf(t)
+	engine := policyEngine(t, `{
+		"policies": [{"name": "traffic", "bytes": 1000}]
+	}`)
+	get := func() (int, string) {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/large", nil))
+		return recorder.Code, recorder.Header().Get("X-Ratelimit-Bytes")
+	}
+	code, _ := get()
+	assert.Equal(t, 200, code)
+	code, count := get()
+	assert.Equal(t, "500", count, "Downloaded bytes are counted")
+	get()
+	code, _ = get()
+	assert.Equal(t, 429, code, "Downloads exceed the budget")
+
+	conf(t)
+	request := httptest.NewRequest("POST", "/echo", strings.NewReader(strings.Repeat("b", 600)))
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+	assert.Equal(t, 600, recorder.Body.Len())
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/large", nil))
+	assert.Equal(t, 429, recorder.Code, "Chunked uploads are counted")
+}
+
+func TestUserStorageQuota(t *testing.T) {
+	os.Setenv("STORAGE_QUOTA", "20")
+	defer os.Unsetenv("STORAGE_QUOTA")
+	conf := conf(t)
+	userid := createUser(t, conf, "moo")
+	var profile map[string]interface{}
+
+	conf.PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"puts 'moo'","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+		})
+	conf.PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"puts 'moo moo'","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 507, r.Code, "ResponseCode should be 507")
+		})
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"puts 'moo moo'","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "Anonymous gists are not accounted")
+		})
+	conf.GET("/v1/users/"+userid+"/profile").
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &profile)
+		})
+	storage := profile["storage"].(map[string]interface{})
+	assert.Equal(t, float64(10), storage["used"])
+	assert.Equal(t, float64(20), storage["quota"])
+}
+
+func TestReleaseStorageOverQuota(t *testing.T) {
+	defer os.Unsetenv("STORAGE_QUOTA")
+	userid := createUser(t, conf(t), "lowered")
+	var created map[string]interface{}
+	gofight.New().PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"0123456789","lang":"text"},{"paste":"abcdefghij","lang":"text"}]}`).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(res.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	user := models.User{UUID: userid}
+	used, err := user.StorageUsed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), used)
+
+	os.Setenv("STORAGE_QUOTA", "5")
+	snippet := helper.RedisClient().SMembers("gists::" + uuid).Val()[0]
+	gofight.New().DELETE("/v1/users/"+userid+"/gists/"+uuid+"/snippets/"+snippet).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+		})
+	used, err = user.StorageUsed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), used, "Users over a lowered quota get bytes back")
+	assert.Nil(t, user.ReleaseStorage(100))
+	used, err = user.StorageUsed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), used, "Usage doesn't drop below zero")
+}
+
+func TestGistCreateLimits(t *testing.T) {
+	limits := map[string]string{
+		"MAX_BODY_BYTES":    "200",
+		"MAX_SNIPPETS":      "2",
+		"MAX_SNIPPET_BYTES": "20",
+		"ALLOWED_LANGS":     "ruby,go",
+	}
+	for key, value := range limits {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	conf := conf(t)
+	var created map[string]interface{}
+	var invalid map[string]interface{}
+
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"` + strings.Repeat("a", 300) + `"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 413, r.Code, "ResponseCode should be 413")
+		})
+
+	request := httptest.NewRequest("POST", "/v1/gists",
+		strings.NewReader(`{"snippets":[{"paste":"`+strings.Repeat("a", 300)+`"}]}`))
+	request.ContentLength = -1
+	recorder := httptest.NewRecorder()
+	GetEngine().ServeHTTP(recorder, request)
+	assert.Equal(t, 413, recorder.Code, "Chunked bodies are limited while decoding")
+
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":" "},{"paste":"` + strings.Repeat("a", 21) + `","lang":"cobol"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "ResponseCode should be 422")
+			json.Unmarshal(r.Body.Bytes(), &invalid)
+		})
+	fields := []string{}
+	for _, e := range invalid["details"].([]interface{}) {
+		fields = append(fields, e.(map[string]interface{})["field"].(string))
+	}
+	assert.Equal(t, []string{"snippets[0].paste", "snippets[1].paste", "snippets[1].lang"}, fields)
+
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"a"},{"paste":"b"},{"paste":"c"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "Too many snippets")
+		})
+
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"puts 1","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	conf.POST("/v1/gists/"+uuid).
+		SetBody(`{"snippets":[{"paste":"puts 2"},{"paste":"puts 3"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 422, r.Code, "Existing snippets are counted")
+		})
+	conf.POST("/v1/gists/"+uuid).
+		SetBody(`{"snippets":[{"paste":"puts 2"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+		})
+}
+
+func TestErrorResponses(t *testing.T) {
+	conf := conf(t)
+	expect := func(method string, path string, body string, status int, code string) map[string]interface{} {
+		var response map[string]interface{}
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		GetEngine().ServeHTTP(recorder, request)
+		assert.Equal(t, status, recorder.Code, method+" "+path)
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response), "Body is a single json document")
+		assert.Equal(t, code, response["code"], method+" "+path)
+		assert.NotEmpty(t, response["message"])
+		assert.Contains(t, response, "details")
+		assert.Equal(t, recorder.Header().Get("X-Request-Id"), response["request_id"])
+		return response
+	}
+
+	expect("GET", "/v1/gists/unknown", "", 404, "not_found")
+	expect("GET", "/unknown", "", 404, "not_found")
+	expect("GET", "/v1/users/unknown/profile", "", 404, "not_found")
+	expect("PUT", "/v1/users/unknown/uuid", "", 404, "not_found")
+	response := expect("POST", "/v1/gists", "{", 400, "bad_request")
+	assert.NotEmpty(t, response["details"], "Parser error is passed")
+	expect("POST", "/v1/gists", `{"snippets": []}`, 400, "bad_request")
+	expect("POST", "/v1/users/authorize", `{"username": "moo"}`, 400, "bad_request")
+	expect("POST", "/v1/users/authorize", `{"username": "moo", "password": "pass"}`, 403, "forbidden")
+	expect("POST", "/v1/gists/unknown/comments", `{"body": "moo"}`, 401, "unauthorized")
+
+	conf.GET("/v1/gists/unknown").
+		SetHeader(gofight.H{"X-Request-Id": "moo-123"}).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			var response map[string]interface{}
+			json.Unmarshal(r.Body.Bytes(), &response)
+			assert.Equal(t, "moo-123", r.HeaderMap.Get("X-Request-Id"), "Request id of the client is kept")
+			assert.Equal(t, "moo-123", response["request_id"])
+		})
+}
+
+func TestCorruptSnippetReturns500(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	var response map[string]interface{}
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"puts 1","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	for _, snippet := range helper.RedisClient().SMembers("gists::" + uuid).Val() {
+		helper.RedisClient().Set("snippets::"+snippet, "\x00garbage", 0)
+	}
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 500, r.Code, "ResponseCode should be 500")
+			json.Unmarshal(r.Body.Bytes(), &response)
+		})
+	assert.Equal(t, "internal_error", response["code"])
+}
+
+func TestUnzipReportsErrors(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	os.Setenv("COMPRESSION", "gzip")
+	_, err := helper.Unzip("not gzip")
+	assert.NotNil(t, err, "Invalid data is reported")
+	value, err := helper.Unzip(helper.Zip("moo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "moo", value)
+}
+
+func TestHealth(t *testing.T) {
+	var health map[string]interface{}
+	engine := GetEngine()
+	for i := 0; i < 50; i++ {
+		conf(t).GET("/v1/health").
+			Run(engine, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				json.Unmarshal(r.Body.Bytes(), &health)
+				if health["status"] == "ok" {
+					assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+				} else {
+					assert.Equal(t, 503, r.Code, "ResponseCode should be 503")
+				}
+			})
+		if health["status"] == "ok" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "ok", health["redis"], "Redis is reachable")
+	offload := health["offload"].(map[string]interface{})
+	assert.Contains(t, offload, "online")
+	assert.Contains(t, offload, "reconnects")
+}
+
+func TestSweepOffloadsExpiredValues(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"swept away","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snippets := helper.RedisClient().SMembers("gists::" + uuid).Val()
+	for _, snippet := range snippets {
+		helper.RedisClient().Del("shadow::snippets::" + snippet)
+	}
+	swept, err := v1.Sweep(helper.RedisClient())
+	assert.Nil(t, err)
+	assert.True(t, swept >= len(snippets), "Expired snippets are swept")
+	for _, snippet := range snippets {
+		assert.False(t, helper.RedisClient().Exists("snippets::"+snippet).Val(),
+			"Snippet is moved to cold storage")
+	}
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Contains(t, r.Body.String(), "swept away")
+		})
+}
+
+func TestOffloadQueue(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"queued","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r := helper.RedisClient()
+	snippets := r.SMembers("gists::" + uuid).Val()
+	for _, snippet := range snippets {
+		key := "snippets::" + snippet
+		assert.Nil(t, r.ZScore(models.OffloadQueue, key).Err(), "Cached snippet is queued")
+		assert.Nil(t, models.Offload(key))
+		assert.True(t, r.Exists(key).Val(), "Snippet isn't offloaded while cached")
+
+		r.Del("shadow::" + key)
+		r.ZAdd(models.OffloadQueue, redis.Z{Score: 1, Member: key})
+	}
+	done, errs := models.OffloadDue(1000)
+	assert.Empty(t, errs)
+	assert.True(t, done >= len(snippets), "Due snippets are offloaded")
+	for _, snippet := range snippets {
+		key := "snippets::" + snippet
+		assert.False(t, r.Exists(key).Val(), "Snippet is moved to cold storage")
+		assert.Equal(t, redis.Nil, r.ZScore(models.OffloadQueue, key).Err(), "Snippet is dequeued")
+		assert.Nil(t, models.Offload(key), "Offloading twice is harmless")
+	}
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Contains(t, r.Body.String(), "queued")
+		})
+	for _, snippet := range snippets {
+		assert.Nil(t, r.ZScore(models.OffloadQueue, "snippets::"+snippet).Err(),
+			"Snippet is queued again once it's loaded")
+	}
+}
+
+func TestOffloadClaims(t *testing.T) {
+	conf := conf(t)
+	var created map[string]interface{}
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"claimed","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r := helper.RedisClient()
+	snippets := r.SMembers("gists::" + uuid).Val()
+	future := float64(time.Now().Add(time.Hour).Unix())
+	for _, snippet := range snippets {
+		key := "snippets::" + snippet
+		r.Del("shadow::" + key)
+		r.ZAdd(models.OffloadClaims, redis.Z{Score: future, Member: key})
+		assert.Nil(t, models.Offload(key))
+		assert.True(t, r.Exists(key).Val(), "Snippet claimed by another instance is kept")
+
+		r.ZAdd(models.OffloadClaims, redis.Z{Score: 1, Member: key})
+	}
+	_, errs := models.OffloadDue(1000)
+	assert.Empty(t, errs)
+	for _, snippet := range snippets {
+		key := "snippets::" + snippet
+		assert.False(t, r.Exists(key).Val(), "Snippet of a timed out claim is offloaded")
+		assert.Equal(t, redis.Nil, r.ZScore(models.OffloadClaims, key).Err(), "Claim is released")
+	}
+}
+
+func TestOffloadBacklog(t *testing.T) {
+	conf := conf(t)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r := helper.RedisClient()
+	var keys []string
+	for i := 0; i < 5; i++ {
+		uuid := postGist(t, conf, "/v1/gists", fmt.Sprintf("backlog %d", i))
+		key := "snippets::" + r.SMembers("gists::"+uuid).Val()[0]
+		r.Del("shadow::" + key)
+		r.ZAdd(models.OffloadQueue, redis.Z{Score: 1, Member: key})
+		keys = append(keys, key)
+	}
+	cached := "snippets::" + r.SMembers("gists::"+postGist(t, conf, "/v1/gists", "cached")).Val()[0]
+	r.ZAdd(models.OffloadQueue, redis.Z{Score: 1, Member: cached})
+
+	done, errs := v1.OffloadBacklog(2)
+	assert.Empty(t, errs)
+	assert.Equal(t, 6, done, "The backlog is drained at once")
+	for _, key := range keys {
+		assert.False(t, r.Exists(key).Val(), "Queued snippet is offloaded")
+	}
+	assert.True(t, r.Exists(cached).Val(), "Cached snippet is kept")
+	score := r.ZScore(models.OffloadQueue, cached).Val()
+	assert.True(t, score > float64(time.Now().Unix()), "Cached snippet is queued by its expiry")
+}
+
+func TestColdStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "muh")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, backend := range []string{"dir", "sqlite"} {
+		path := dir + "/" + backend
+		store, err := helper.OpenColdStore(backend, path)
+		assert.Nil(t, err, backend)
+		_, err = store.Get("snippets::missing")
+		assert.Equal(t, helper.ErrNotFound, err, backend)
+		assert.Nil(t, store.Set("snippets::1", "\x00moo"), backend)
+		assert.Nil(t, store.Set("snippets::1", "\x00muh"), backend)
+		assert.Nil(t, store.Set("bodies::a", "\x00moo"), backend)
+		keys, err := store.Keys("bodies::")
+		assert.Nil(t, err, backend)
+		assert.Equal(t, []string{"bodies::a"}, keys, backend)
+
+		// a second node opens the same storage
+		other, err := helper.OpenColdStore(backend, path)
+		assert.Nil(t, err, backend)
+		value, err := other.Get("snippets::1")
+		assert.Nil(t, err, backend)
+		assert.Equal(t, "\x00muh", value, backend)
+		assert.Nil(t, other.Del("snippets::1"), backend)
+		assert.Nil(t, other.Del("snippets::1"), backend)
+		_, err = store.Get("snippets::1")
+		assert.Equal(t, helper.ErrNotFound, err, backend)
+
+		swapped, err := other.CompareAndSet("bodies::a", "\x00muh", "\x00sealed")
+		assert.Nil(t, err, backend)
+		assert.False(t, swapped, "Changed values aren't replaced")
+		swapped, err = other.CompareAndSet("bodies::a", "\x00moo", "\x00sealed")
+		assert.Nil(t, err, backend)
+		assert.True(t, swapped, backend)
+		value, _ = store.Get("bodies::a")
+		assert.Equal(t, "\x00sealed", value, backend)
+		swapped, err = store.CompareAndSet("snippets::1", "\x00muh", "\x00sealed")
+		assert.Nil(t, err, backend)
+		assert.False(t, swapped, "Deleted values aren't written again")
+		_, err = store.Get("snippets::1")
+		assert.Equal(t, helper.ErrNotFound, err, backend)
+		keys, _ = store.Keys("")
+		assert.Equal(t, []string{"bodies::a"}, keys, backend)
+		other.Close()
+		store.Close()
+	}
+	_, err = helper.OpenColdStore("tape", dir)
+	assert.NotNil(t, err, "Unknown backends are rejected")
+}
+
+func TestSharedColdStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "muh")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	local := helper.Cold
+	defer func() { helper.Cold = local }()
+
+	conf := conf(t)
+	var created map[string]interface{}
+	conf.POST("/v1/gists").
+		SetBody(`{"snippets":[{"paste":"shared","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+
+	// node A offloads, node B reads the snippet back
+	helper.Cold, _ = helper.OpenColdStore("dir", dir)
+	for _, snippet := range helper.RedisClient().SMembers("gists::" + uuid).Val() {
+		helper.RedisClient().Del("shadow::snippets::" + snippet)
+		assert.Nil(t, models.Offload("snippets::"+snippet))
+	}
+	helper.Cold, _ = helper.OpenColdStore("dir", dir)
+	conf.GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, r.Code, "ResponseCode should be 200")
+			assert.Contains(t, r.Body.String(), "shared")
+		})
+}
+
+// bodyKey returns the key the body of a paste is stored by.
+func bodyKey(t *testing.T, paste string) string {
+	id, err := models.BodyID(paste)
+	assert.Nil(t, err)
+	return "bodies::" + id
+}
+
+func postGist(t *testing.T, conf *gofight.RequestConfig, path string, paste string) string {
+	var created map[string]interface{}
+	conf.POST(path).
+		SetBody(`{"snippets":[{"paste":"` + paste + `","lang":"ruby"}]}`).
+		Run(GetEngine(), func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 201, r.Code, "ResponseCode should be 201")
+			json.Unmarshal(r.Body.Bytes(), &created)
+		})
+	return created["gist"].(map[string]interface{})["uuid"].(string)
+}
+
+func TestCachingTime(t *testing.T) {
+	defer os.Setenv("CACHING_TIME", os.Getenv("CACHING_TIME"))
+	os.Setenv("CACHING_TIME", "10m")
+	uuid := postGist(t, conf(t), "/v1/gists", "cached")
+	for _, snippet := range helper.RedisClient().SMembers("gists::" + uuid).Val() {
+		ttl := helper.RedisClient().PTTL("shadow::snippets::" + snippet).Val()
+		assert.True(t, ttl > 9*time.Minute && ttl <= 10*time.Minute, "CACHING_TIME is applied")
+	}
+}
+
+func TestTieringPolicies(t *testing.T) {
+	defer os.Setenv("TIERING_POLICY", os.Getenv("TIERING_POLICY"))
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r := helper.RedisClient()
+
+	os.Setenv("TIERING_POLICY", "lru")
+	uuid := postGist(t, conf(t), "/v1/gists", "recent")
+	key := "snippets::" + r.SMembers("gists::"+uuid).Val()[0]
+	r.PExpire("shadow::"+key, time.Second)
+	gofight.New().GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+		})
+	assert.True(t, r.PTTL("shadow::"+key).Val() > time.Minute, "lru extends the cache on reads")
+
+	os.Setenv("TIERING_POLICY", "lfu")
+	uuid = postGist(t, conf(t), "/v1/gists", "frequent")
+	key = "snippets::" + r.SMembers("gists::"+uuid).Val()[0]
+	for i := 0; i < 2; i++ {
+		gofight.New().GET("/v1/gists/"+uuid).
+			Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	}
+	r.Del("shadow::" + key)
+	assert.Nil(t, models.Offload(key))
+	assert.True(t, r.Exists("shadow::"+key).Val(), "lfu keeps frequently read values")
+	r.Del("shadow::" + key)
+	assert.Nil(t, models.Offload(key))
+	assert.False(t, r.Exists(key).Val(), "lfu offloads values read rarely")
+
+	stats, err := models.TierStats()
+	assert.Nil(t, err)
+	assert.Equal(t, "lfu", stats["policy"])
+	assert.Equal(t, int64(4), stats["hot_hits"], "Each read hits snippet and paste")
+	assert.Equal(t, int64(1), stats["demotions"])
+	assert.Equal(t, 1.0, stats["hot_ratio"])
+}
+
+func TestHotMaxBytes(t *testing.T) {
+	defer os.Setenv("HOT_MAX_BYTES", os.Getenv("HOT_MAX_BYTES"))
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	os.Setenv("HOT_MAX_BYTES", "10")
+	r := helper.RedisClient()
+	uuid := postGist(t, conf(t), "/v1/gists", "a paste too large for redis")
+	key := bodyKey(t, "a paste too large for redis")
+	assert.False(t, r.Exists(key).Val(), "Large pastes are stored cold")
+	gofight.New().GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			assert.Contains(t, res.Body.String(), "too large")
+		})
+	assert.False(t, r.Exists(key).Val(), "Large pastes aren't promoted")
+	stats, _ := models.TierStats()
+	assert.Equal(t, int64(2), stats["cold_hits"], "Snippet and paste are read cold")
+	assert.Equal(t, int64(0), stats["promotions"])
+}
+
+func TestGistPinning(t *testing.T) {
+	defer os.Setenv("HOT_MAX_BYTES", os.Getenv("HOT_MAX_BYTES"))
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conf := conf(t)
+	r := helper.RedisClient()
+	userid := createUser(t, conf, "pinner")
+	uuid := postGist(t, gofight.New(), "/v1/gists", "unowned")
+	gofight.New().PUT("/v1/users/"+userid+"/gists/"+uuid+"/pin").
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, res.Code, "Only owned gists are pinned")
+		})
+
+	os.Setenv("HOT_MAX_BYTES", "10")
+	var created map[string]interface{}
+	gofight.New().PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"pinned but large","lang":"ruby"}]}`).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(res.Body.Bytes(), &created)
+		})
+	uuid = created["gist"].(map[string]interface{})["uuid"].(string)
+	key := bodyKey(t, "pinned but large")
+	assert.False(t, r.Exists(key).Val(), "Large pastes are stored cold")
+
+	gofight.New().PUT("/v1/users/"+userid+"/gists/"+uuid+"/pin").
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			assert.Contains(t, res.Body.String(), `"pinned":true`)
+		})
+	assert.True(t, r.Exists(key).Val(), "Pinned snippets are loaded into redis")
+	assert.True(t, r.Exists("shadow::"+key).Val() && r.PTTL("shadow::"+key).Val() < 0,
+		"Pinned snippets don't expire")
+	assert.Equal(t, redis.Nil, r.ZScore(models.OffloadQueue, key).Err(), "Pinned snippets aren't queued")
+
+	os.Setenv("HOT_MAX_BYTES", "")
+	gofight.New().DELETE("/v1/users/"+userid+"/gists/"+uuid+"/pin").
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			assert.Contains(t, res.Body.String(), `"pinned":false`)
+		})
+	assert.True(t, r.PTTL("shadow::"+key).Val() > 0, "Unpinned snippets expire again")
+	assert.Nil(t, r.ZScore(models.OffloadQueue, key).Err(), "Unpinned snippets are queued")
+
+	gofight.New().PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"pinned but large","lang":"text"}]}`).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(res.Body.Bytes(), &created)
+		})
+	shared := created["gist"].(map[string]interface{})["uuid"].(string)
+	for _, id := range []string{uuid, shared, shared} {
+		gofight.New().PUT("/v1/users/"+userid+"/gists/"+id+"/pin").
+			Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			})
+	}
+	gofight.New().DELETE("/v1/users/"+userid+"/gists/"+uuid+"/pin").
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+		})
+	assert.True(t, r.SIsMember("tier::pinned", key).Val(), "Bodies of another pinned gist stay pinned")
+	assert.True(t, r.PTTL("shadow::"+key).Val() < 0, "Bodies of another pinned gist don't expire")
+	gofight.New().DELETE("/v1/users/"+userid+"/gists/"+shared+"/pin").
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+		})
+	assert.False(t, r.SIsMember("tier::pinned", key).Val(), "Bodies are unpinned with the last gist")
+	assert.True(t, r.PTTL("shadow::"+key).Val() > 0, "Bodies expire with the last gist unpinned")
+}
+
+func TestSnippetDedup(t *testing.T) {
+	conf := conf(t)
+	r := helper.RedisClient()
+	userid := createUser(t, conf, "dedup")
+	var created map[string]interface{}
+	gofight.New().PUT("/v1/users/"+userid+"/gists").
+		SetBody(`{"snippets":[{"paste":"shared","lang":"ruby"},{"paste":"shared","lang":"text"}]}`).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			json.Unmarshal(res.Body.Bytes(), &created)
+		})
+	uuid := created["gist"].(map[string]interface{})["uuid"].(string)
+	hash := models.ContentHash("shared")
+	key := bodyKey(t, "shared")
+	refs := "refs::" + key
+	assert.True(t, r.Exists(key).Val(), "Pastes are stored by content")
+	assert.Equal(t, "2", r.Get(refs).Val(), "Identical pastes share one body")
+
+	snippets := r.SMembers("gists::" + uuid).Val()
+	assert.Len(t, snippets, 2)
+	gofight.New().GET("/v1/gists/"+uuid).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			var gist map[string]map[string]map[string]string
+			json.Unmarshal(res.Body.Bytes(), &gist)
+			for _, snippet := range gist["snippets"] {
+				assert.Equal(t, hash, snippet["hash"])
+				assert.Equal(t, "shared", snippet["paste"])
+			}
+		})
+
+	path := "/v1/users/" + userid + "/gists/" + uuid + "/snippets/"
+	gofight.New().DELETE("/v1/users/unknown/gists/"+uuid+"/snippets/"+snippets[0]).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, res.Code, "Only snippets of owned gists are deleted")
+		})
+	gofight.New().DELETE(path+snippets[0]).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			assert.Contains(t, res.Body.String(), hash)
+		})
+	assert.False(t, r.Exists("snippets::"+snippets[0]).Val(), "Snippet is deleted")
+	assert.True(t, r.Exists(key).Val(), "Referenced bodies are kept")
+	assert.Equal(t, "1", r.Get(refs).Val())
+	gofight.New().DELETE(path+snippets[0]).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 404, res.Code, "ResponseCode should be 404")
+		})
+	gofight.New().DELETE(path+snippets[1]).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+		})
+	assert.False(t, r.Exists(key).Val(), "Unreferenced bodies are freed")
+	assert.False(t, r.Exists(refs).Val())
+	_, err := helper.ColdGet(key)
+	assert.NotEqual(t, nil, err, "Unreferenced bodies are freed in cold storage")
+	user := models.User{UUID: userid}
+	used, err := user.StorageUsed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), used, "Deleted snippets release storage")
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	defer os.Setenv("ENCRYPTION_KEYS", os.Getenv("ENCRYPTION_KEYS"))
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	dir, err := ioutil.TempDir("", "muh")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	local := helper.Cold
+	defer func() { helper.Cold = local }()
+	helper.Cold, _ = helper.OpenColdStore("dir", dir)
+
+	old := "old:" + strings.Repeat("A", 43) + "="
+	os.Setenv("ENCRYPTION_KEYS", old)
+	os.Setenv("COMPRESSION", "gzip")
+	r := helper.RedisClient()
+	hot := postGist(t, conf(t), "/v1/gists", "hot secret")
+	postGist(t, gofight.New(), "/v1/gists", "cold secret")
+	hotKey := bodyKey(t, "hot secret")
+	coldKey := bodyKey(t, "cold secret")
+	assert.False(t, r.Exists("bodies::"+models.ContentHash("hot secret")).Val(),
+		"Bodies aren't stored by their content hash")
+	snippet := r.SMembers("gists::" + hot).Val()[0]
+	stored, _ := helper.Unzip(r.Get("snippets::" + snippet).Val())
+	assert.NotContains(t, stored, models.ContentHash("hot secret"),
+		"Snippets don't store the content hash")
+	assert.Equal(t, "old", helper.SealedBy(r.Get(hotKey).Val()), "Bodies are sealed by the active key")
+	r.Del("shadow::" + coldKey)
+	assert.Nil(t, models.Offload(coldKey))
+	blob, err := helper.ColdGet(coldKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", helper.SealedBy(blob), "Bodies stay sealed in cold storage")
+	opened, err := helper.Open(blob)
+	assert.Nil(t, err)
+	unzipped, _ := helper.Unzip(opened)
+	assert.Equal(t, "cold secret", unzipped)
+
+	engine := GetEngine()
+	request := httptest.NewRequest("GET", "/v1/gists/"+hot+"/snippets/"+snippet+"/raw", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response := httptest.NewRecorder()
+	engine.ServeHTTP(response, request)
+	assert.Equal(t, "gzip", response.Header().Get("Content-Encoding"), "Decrypted pastes are passed through")
+
+	r.Set("snippets::legacy", helper.Zip(`{"paste":"legacy hot secret","lang":"text"}`), 0)
+	helper.ColdSet("snippets::legacycold", helper.Zip(`{"paste":"legacy cold secret","lang":"text"}`))
+	r.SAdd("gists::"+hot, "legacy", "legacycold")
+
+	os.Setenv("ENCRYPTION_KEYS", "new:"+strings.Repeat("B", 43)+"=,"+old)
+	rotation, err := models.RequestRotation()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rotation)
+	resealed, errs := models.RotateKeys()
+	assert.Empty(t, errs)
+	assert.Equal(t, 4, resealed, "Hot and cold bodies are re-encrypted, inline pastes are moved")
+	assert.Equal(t, "new", helper.SealedBy(r.Get(hotKey).Val()))
+	blob, _ = helper.ColdGet(coldKey)
+	assert.Equal(t, "new", helper.SealedBy(blob))
+	legacy, _ := helper.Unzip(r.Get("snippets::legacy").Val())
+	assert.NotContains(t, legacy, "secret", "Inline pastes are moved into bodies")
+	legacy, _ = helper.ColdGet("snippets::legacycold")
+	legacy, _ = helper.Unzip(legacy)
+	assert.NotContains(t, legacy, "secret", "Inline pastes are moved into bodies in cold storage")
+	assert.Equal(t, "new", helper.SealedBy(r.Get(bodyKey(t, "legacy hot secret")).Val()))
+	resealed, errs = models.RotateKeys()
+	assert.Equal(t, 0, resealed, "Finished rotations aren't repeated")
+	stats, err := models.EncryptionStats()
+	assert.Nil(t, err)
+	assert.Equal(t, "new", stats["key"])
+	assert.Equal(t, false, stats["pending"])
+
+	os.Setenv("ENCRYPTION_KEYS", "new:"+strings.Repeat("B", 43)+"=")
+	gofight.New().GET("/v1/gists/"+hot).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "Rotated bodies don't need the old key")
+			assert.Contains(t, res.Body.String(), "hot secret")
+			assert.Contains(t, res.Body.String(), "legacy cold secret")
+		})
+	os.Setenv("ENCRYPTION_KEYS", old)
+	_, err = helper.Open(blob)
+	assert.Equal(t, helper.ErrUnknownKey, err, "Bodies of unknown keys can't be opened")
+	os.Setenv("ENCRYPTION_KEYS", "broken")
+	_, err = models.RequestRotation()
+	assert.NotNil(t, err, "Rotations need a valid keyring")
+
+	file, err := ioutil.TempFile("", "keys")
+	assert.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+	defer os.Unsetenv("ENCRYPTION_KEYS_FILE")
+	os.Setenv("ENCRYPTION_KEYS", "")
+	os.Setenv("ENCRYPTION_KEYS_FILE", file.Name())
+	ioutil.WriteFile(file.Name(), []byte("new:"+strings.Repeat("B", 43)+"=\n"+old+"\n"), 0600)
+	stats, err = models.EncryptionStats()
+	assert.Nil(t, err)
+	assert.Equal(t, false, stats["pending"], "Rotations are done by the key they sealed by")
+	ioutil.WriteFile(file.Name(), []byte(old+"\nnew:"+strings.Repeat("B", 43)+"=\n"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file.Name(), later, later)
+	stats, err = models.EncryptionStats()
+	assert.Nil(t, err)
+	assert.Equal(t, "old", stats["key"], "Changed key files are loaded again")
+	assert.Equal(t, true, stats["pending"], "Rotations are repeated for a changed active key")
+	resealed, errs = models.RotateKeys()
+	assert.Empty(t, errs)
+	assert.Equal(t, 4, resealed)
+	assert.Equal(t, "old", helper.SealedBy(r.Get(hotKey).Val()))
+}
+
+func TestBodyFingerprint(t *testing.T) {
+	defer os.Setenv("ENCRYPTION_KEYS", os.Getenv("ENCRYPTION_KEYS"))
+	defer os.Setenv("ENCRYPTION_KEY_ID", os.Getenv("ENCRYPTION_KEY_ID"))
+	defer os.Unsetenv("ENCRYPTION_FINGERPRINT_KEY")
+	dir, err := ioutil.TempDir("", "muh")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50 && helper.Cold == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	local := helper.Cold
+	defer func() { helper.Cold = local }()
+	helper.Cold, _ = helper.OpenColdStore("dir", dir)
+
+	r := helper.RedisClient()
+	os.Setenv("ENCRYPTION_KEYS", "")
+	os.Setenv("ENCRYPTION_KEY_ID", "")
+	postGist(t, conf(t), "/v1/gists", "shared secret")
+	plain := "bodies::" + models.ContentHash("shared secret")
+	assert.True(t, r.Exists(plain).Val(), "Bodies are stored by their content hash without keys")
+
+	keys := "old:" + strings.Repeat("A", 43) + "=,new:" + strings.Repeat("B", 43) + "="
+	os.Setenv("ENCRYPTION_KEYS", keys)
+	postGist(t, gofight.New(), "/v1/gists", "shared secret")
+	keyed := bodyKey(t, "shared secret")
+	assert.NotEqual(t, plain, keyed)
+	os.Setenv("ENCRYPTION_KEY_ID", "new")
+	assert.Equal(t, keyed, bodyKey(t, "shared secret"), "Fingerprints outlast a change of the active key")
+	postGist(t, gofight.New(), "/v1/gists", "shared secret")
+	assert.Equal(t, "2", r.Get("refs::"+keyed).Val(), "Pastes before and after a rotation share their body")
+
+	_, err = models.RequestRotation()
+	assert.Nil(t, err)
+	_, errs := models.RotateKeys()
+	assert.Empty(t, errs)
+	assert.False(t, r.Exists(plain).Val(), "Bodies stored before encryption are moved")
+	assert.Equal(t, "3", r.Get("refs::"+keyed).Val(), "Moved bodies are shared")
+	assert.Equal(t, "new", helper.SealedBy(r.Get(keyed).Val()))
+
+	os.Setenv("ENCRYPTION_KEYS", "new:"+strings.Repeat("B", 43)+"=")
+	_, err = models.BodyID("shared secret")
+	assert.Equal(t, helper.ErrFingerprintKey, err, "The recorded fingerprint key must stay in the keyring")
+	os.Setenv("ENCRYPTION_FINGERPRINT_KEY", strings.Repeat("C", 43)+"=")
+	dedicated := bodyKey(t, "shared secret")
+	assert.NotEqual(t, keyed, dedicated, "ENCRYPTION_FINGERPRINT_KEY takes precedence")
+	os.Setenv("ENCRYPTION_KEYS", keys)
+	_, err = models.RequestRotation()
+	assert.Nil(t, err)
+	_, errs = models.RotateKeys()
+	assert.Empty(t, errs)
+	assert.False(t, r.Exists(keyed).Val(), "Bodies of a previous fingerprint key are moved")
+	assert.Equal(t, "3", r.Get("refs::"+dedicated).Val())
+	gofight.New().GET("/v1/gists/"+postGist(t, gofight.New(), "/v1/gists", "shared secret")).
+		Run(GetEngine(), func(res gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, 200, res.Code, "ResponseCode should be 200")
+			assert.Contains(t, res.Body.String(), "shared secret")
+		})
+	assert.Equal(t, "4", r.Get("refs::"+dedicated).Val())
+}
+
+func TestUnzipDetectsCodec(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	var stored []string
+	for _, codec := range []string{"", "gzip", "snappy"} {
+		os.Setenv("COMPRESSION", codec)
+		stored = append(stored, helper.Zip(`{"paste":"moo"}`))
+	}
+	for _, codec := range []string{"", "gzip", "snappy"} {
+		os.Setenv("COMPRESSION", codec)
+		for _, value := range stored {
+			decoded, err := helper.Unzip(value)
+			assert.Nil(t, err, "Values of any codec are decoded")
+			assert.Equal(t, `{"paste":"moo"}`, decoded)
+		}
+	}
+
+	os.Setenv("COMPRESSION", "snappy")
+	_, err := helper.Unzip("\xffmuh?moo")
+	assert.Equal(t, helper.ErrUnknownCodec, err)
+
+	defer os.Unsetenv("LEGACY_COMPRESSION")
+	os.Setenv("LEGACY_COMPRESSION", "")
+	decoded, err := helper.Unzip(`{"paste":"legacy"}`)
+	assert.Nil(t, err, "Values without codec are decoded by LEGACY_COMPRESSION")
+	assert.Equal(t, `{"paste":"legacy"}`, decoded)
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	defer os.Unsetenv("COMPRESSION_LEVEL")
+	paste := strings.Repeat(`{"paste":"puts 'moo'\n","lang":"ruby"}`, 20)
+	for _, codec := range []string{"gzip", "snappy", "zstd", "lz4", "brotli"} {
+		for _, level := range []string{"", "-3", "0", "1", "9", "12", "30"} {
+			os.Setenv("COMPRESSION", codec)
+			os.Setenv("COMPRESSION_LEVEL", level)
+			zipped := helper.Zip(paste)
+			assert.True(t, len(zipped) < len(paste), codec+" compresses")
+			os.Setenv("COMPRESSION", "")
+			unzipped, err := helper.Unzip(zipped)
+			assert.Nil(t, err, codec)
+			assert.Equal(t, paste, unzipped, codec)
+		}
+	}
+	stats := helper.CodecStats()
+	for _, codec := range []string{"gzip", "snappy", "zstd", "lz4", "brotli"} {
+		assert.Contains(t, stats, codec)
+		assert.True(t, stats[codec]["ratio"].(float64) < 1, codec+" reports its ratio")
+	}
+	os.Setenv("COMPRESSION", "brotli")
+	os.Setenv("COMPRESSION_LEVEL", "0")
+	fastest := helper.Zip(paste)
+	os.Setenv("COMPRESSION_LEVEL", "")
+	assert.NotEqual(t, fastest, helper.Zip(paste), "brotli level 0 is selectable")
+}
+
+func TestCompressionAuto(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	os.Setenv("COMPRESSION", "auto")
+	assert.Equal(t, "\xffmuhn{}", helper.Zip("{}"), "Tiny values aren't compressed")
+	random := make([]byte, 1024)
+	for i := range random {
+		random[i] = byte(i*7919%251) ^ byte(i>>3)
+	}
+	assert.Equal(t, "\xffmuhn"+string(random), helper.Zip(string(random)),
+		"Incompressible values aren't compressed")
+	paste := strings.Repeat("package main\n", 100)
+	zipped := helper.Zip(paste)
+	assert.True(t, strings.HasPrefix(zipped, "\xffmuhz"), "Other values are compressed by zstd")
+	unzipped, err := helper.Unzip(zipped)
+	assert.Nil(t, err)
+	assert.Equal(t, paste, unzipped)
+}
+
+func TestZstdDictionary(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	defer os.Unsetenv("ZSTD_DICTIONARY")
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(
+			"package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(%d)\n}\n", i)))
+	}
+	dictionary, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 1})
+	assert.Nil(t, err)
+	file, err := ioutil.TempFile("", "muh-dict")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.Write(dictionary)
+	file.Close()
+
+	os.Setenv("COMPRESSION", "zstd")
+	paste := string(samples[42])
+	plain := helper.Zip(paste)
+	os.Setenv("ZSTD_DICTIONARY", file.Name())
+	trained := helper.Zip(paste)
+	assert.True(t, len(trained) < len(plain), "The dictionary improves compression")
+	unzipped, err := helper.Unzip(trained)
+	assert.Nil(t, err)
+	assert.Equal(t, paste, unzipped)
+
+	defer os.Unsetenv("ZSTD_DICTIONARIES")
+	dictionary, err = dict.BuildZstdDict(samples[100:], dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 2})
+	assert.Nil(t, err)
+	other, err := ioutil.TempFile("", "muh-dict")
+	assert.Nil(t, err)
+	defer os.Remove(other.Name())
+	other.Write(dictionary)
+	other.Close()
+	os.Setenv("ZSTD_DICTIONARY", other.Name())
+	_, err = helper.Unzip(trained)
+	assert.NotNil(t, err, "Values need the dictionary they were compressed with")
+	os.Setenv("ZSTD_DICTIONARIES", file.Name())
+	retrained := helper.Zip(paste)
+	for _, value := range []string{trained, retrained, plain} {
+		unzipped, err = helper.Unzip(value)
+		assert.Nil(t, err, "Values of previous dictionaries are decoded")
+		assert.Equal(t, paste, unzipped)
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	uuid := postGist(t, conf(t), "/v1/gists", "compressed response")
+	engine := GetEngine()
+	for _, encoding := range []string{"gzip", "br"} {
+		request := httptest.NewRequest("GET", "/v1/gists/"+uuid, nil)
+		request.Header.Set("Accept-Encoding", encoding+", identity;q=0.5")
+		response := httptest.NewRecorder()
+		engine.ServeHTTP(response, request)
+		assert.Equal(t, 200, response.Code, "ResponseCode should be 200")
+		assert.Equal(t, encoding, response.Header().Get("Content-Encoding"))
+		assert.Contains(t, response.Header().Get("Vary"), "Accept-Encoding")
+		var reader io.Reader = brotli.NewReader(response.Body)
+		if encoding == "gzip" {
+			reader, _ = gzip.NewReader(response.Body)
+		}
+		body, err := ioutil.ReadAll(reader)
+		assert.Nil(t, err, encoding)
+		assert.Contains(t, string(body), "compressed response", encoding)
+	}
+
+	request := httptest.NewRequest("GET", "/v1/gists/"+uuid, nil)
+	request.Header.Set("Accept-Encoding", "gzip;q=0")
+	response := httptest.NewRecorder()
+	engine.ServeHTTP(response, request)
+	assert.Equal(t, "", response.Header().Get("Content-Encoding"), "Refused encodings aren't used")
+	assert.Contains(t, response.Body.String(), "compressed response")
+}
+
+func TestRawSnippet(t *testing.T) {
+	defer os.Setenv("COMPRESSION", os.Getenv("COMPRESSION"))
+	engine := GetEngine()
+	for _, codec := range []string{"gzip", "snappy"} {
+		os.Setenv("COMPRESSION", codec)
+		uuid := postGist(t, conf(t), "/v1/gists", "puts 'raw'")
+		snippet := helper.RedisClient().SMembers("gists::" + uuid).Val()[0]
+		path := "/v1/gists/" + uuid + "/snippets/" + snippet + "/raw"
+
+		request := httptest.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		engine.ServeHTTP(response, request)
+		assert.Equal(t, 200, response.Code, "ResponseCode should be 200")
+		assert.Equal(t, "puts 'raw'", response.Body.String(), codec)
+		assert.Contains(t, response.Header().Get("Content-Type"), "text/plain")
+
+		request = httptest.NewRequest("GET", path, nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		response = httptest.NewRecorder()
+		engine.ServeHTTP(response, request)
+		assert.Equal(t, "gzip", response.Header().Get("Content-Encoding"), codec)
+		compressed := response.Body.String()
+		reader, err := gzip.NewReader(strings.NewReader(compressed))
+		assert.Nil(t, err, codec)
+		body, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, "puts 'raw'", string(body), codec)
+		if codec == "gzip" {
+			blob, _ := helper.Open(helper.RedisClient().Get(bodyKey(t, "puts 'raw'")).Val())
+			_, payload := helper.HTTPEncoding(blob)
+			assert.Equal(t, payload, compressed, "Stored pastes are passed through")
+		}
+
+		request = httptest.NewRequest("GET", "/v1/gists/"+uuid+"/snippets/unknown/raw", nil)
+		response = httptest.NewRecorder()
+		engine.ServeHTTP(response, request)
+		assert.Equal(t, 404, response.Code, "ResponseCode should be 404")
+	}
+}
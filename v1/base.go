@@ -15,19 +15,25 @@
 package v1
 
 import (
-	"github.com/boltdb/bolt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 	"github.com/muhproductions/muh/helper"
 	"github.com/muhproductions/muh/v1/resources"
 	"gopkg.in/redis.v3"
 	"os"
+	"time"
 )
 
 // Routes - Register all routes for API version 1
 func Routes(api *gin.Engine) {
+	api.NoRoute(func(c *gin.Context) {
+		resources.NotFound("Route", c)
+	})
+
 	version := api.Group("/v1")
 	version.Use(Ratelimit())
 	version.GET("/ping", Ping)
+	version.GET("/health", Health)
 
 	resources.UserResource{
 		Engine: version,
@@ -37,32 +43,117 @@ func Routes(api *gin.Engine) {
 		Engine: version,
 	}.Routes()
 
+	resources.CollectionResource{
+		Engine: version,
+	}.Routes()
+
+	resources.CommentResource{
+		Engine: version,
+	}.Routes()
+
+	resources.DiffResource{
+		Engine: version,
+	}.Routes()
+
+	resources.EmbedResource{
+		Engine: version,
+		Root:   api.Group("/", Ratelimit()),
+	}.Routes()
+
 	go EventHandler(helper.RedisClient())
 
 }
 
 // EventHandler will subscribe to keyspace notifications
-// and run callbacks.
+// and run callbacks. A lost subscription is renewed with an
+// exponential backoff, its state is reported by Health.
 func EventHandler(r *redis.Client) {
-	db := "muh.db"
+	cold, err := helper.OpenColdStore(os.Getenv("COLD_STORAGE"), coldStoragePath())
+	if err != nil {
+		panic(err)
+	}
+	helper.Cold = cold
+	notifications := ensureNotifications(r)
+	offload.notify(notifications)
+	if interval := sweepInterval(notifications); interval > 0 {
+		go sweeper(r, interval)
+	}
+	go offloader(offloadInterval())
+	go rotator(rotationInterval())
+	attempt := 0
+	resubscribe := false
+	for {
+		subscribed, err := receiveExpired(r, resubscribe)
+		resubscribe = true
+		if subscribed {
+			attempt = 0
+		}
+		offload.down(err)
+		wait := backoff(attempt)
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1,
+			"retry":   wait.String(),
+		}).Error(err, "Expiry subscription lost")
+		time.Sleep(wait)
+		attempt++
+	}
+}
+
+// coldStoragePath returns COLD_STORAGE_PATH, DB for BoltDB or a default
+// path of the backend.
+func coldStoragePath() string {
+	if os.Getenv("COLD_STORAGE_PATH") != "" {
+		return os.Getenv("COLD_STORAGE_PATH")
+	}
+	switch os.Getenv("COLD_STORAGE") {
+	case "dir":
+		return "muh.cold"
+	case "sqlite":
+		return "muh.sqlite"
+	}
 	if os.Getenv("DB") != "" {
-		db = os.Getenv("DB")
+		return os.Getenv("DB")
 	}
-	b, err := bolt.Open(db, 0600, nil)
+	return "muh.db"
+}
+
+// receiveExpired subscribes to expired events and runs the callbacks
+// until the subscription fails. On a resubscribe the notification flags
+// are checked again, a restarted redis might have lost them.
+func receiveExpired(r *redis.Client, resubscribe bool) (bool, error) {
+	pubsub, err := r.Subscribe("__keyevent@0__:expired")
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	helper.Bolt = b
-	helper.BoltInit()
-	pubsub, _ := r.Subscribe("__keyevent@0__:expired")
+	defer pubsub.Close()
+	if resubscribe {
+		offload.notify(ensureNotifications(r))
+	}
+	offload.up()
 	for {
-		msg, _ := pubsub.ReceiveMessage()
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return true, err
+		}
 		for _, callback := range helper.Callbacks {
 			callback(msg.Payload)
 		}
 	}
 }
 
+// backoff returns the exponential delay before the next reconnect,
+// capped at 30 seconds.
+func backoff(attempt int) time.Duration {
+	if attempt > 8 {
+		return 30 * time.Second
+	}
+	wait := 100 * time.Millisecond << uint(attempt)
+	if wait > 30*time.Second {
+		return 30 * time.Second
+	}
+	return wait
+}
+
 // Ping - a generic ping / pong route
 func Ping(c *gin.Context) {
 	c.JSON(418, gin.H{
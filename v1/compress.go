@@ -0,0 +1,128 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package v1
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/helper"
+	"io"
+	"os"
+	"strings"
+)
+
+// responseEncodings returns the encodings offered to clients, set by
+// RESPONSE_COMPRESSION as comma separated list. Defaults to "br,gzip",
+// "off" disables compressing responses.
+func responseEncodings() []string {
+	setting := os.Getenv("RESPONSE_COMPRESSION")
+	if setting == "" {
+		return []string{"br", "gzip"}
+	}
+	if setting == "off" {
+		return nil
+	}
+	var encodings []string
+	for _, encoding := range strings.Split(setting, ",") {
+		if encoding = strings.TrimSpace(encoding); encoding == "br" || encoding == "gzip" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
+
+// Compress - Middleware compressing responses by brotli or gzip, as
+// negotiated by Accept-Encoding. Responses which are encoded already
+// are passed through.
+func Compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := helper.NegotiateEncoding(c.Request.Header.Get("Accept-Encoding"), responseEncodings()...)
+		if encoding == "" || c.Request.Method == "HEAD" {
+			c.Next()
+			return
+		}
+		writer := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = writer
+		c.Next()
+		writer.close()
+	}
+}
+
+// compressWriter encodes the body once the handler starts writing it.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+	started  bool
+	size     int
+}
+
+func (w *compressWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if header.Get("Content-Encoding") != "" || w.Status() == 204 || w.Status() == 304 {
+		return
+	}
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	if w.encoding == "br" {
+		w.encoder = brotli.NewWriter(w.ResponseWriter)
+	} else {
+		w.encoder = gzip.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	w.start()
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	n, err := w.encoder.Write(data)
+	w.size += n
+	return n, err
+}
+
+// Size returns the bytes of the body before encoding it. Most of the
+// encoded body is still buffered while inner middlewares account it.
+func (w *compressWriter) Size() int {
+	if w.encoder == nil {
+		return w.ResponseWriter.Size()
+	}
+	return w.size
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends the data encoded so far.
+func (w *compressWriter) Flush() {
+	if flusher, ok := w.encoder.(interface {
+		Flush() error
+	}); ok {
+		flusher.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/helper"
+	"github.com/muhproductions/muh/v1/models"
+	"sync"
+	"time"
+)
+
+// offloadState - Health of the expiry subscription, which moves
+// values into cold storage.
+type offloadState struct {
+	sync.RWMutex
+	online     bool
+	since      time.Time
+	lastError  string
+	reconnects int
+	// notifications is set if redis publishes expired events
+	notifications bool
+}
+
+var offload = offloadState{since: time.Now()}
+
+func (s *offloadState) up() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.online {
+		s.online = true
+		s.since = time.Now()
+	}
+}
+
+func (s *offloadState) down(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.online {
+		s.online = false
+		s.since = time.Now()
+	}
+	s.lastError = err.Error()
+	s.reconnects++
+}
+
+func (s *offloadState) notify(enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.notifications = enabled
+}
+
+func (s *offloadState) status() (bool, gin.H) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.online, gin.H{
+		"online":        s.online,
+		"since":         s.since.UTC().Format(time.RFC3339),
+		"last_error":    s.lastError,
+		"reconnects":    s.reconnects,
+		"notifications": s.notifications,
+	}
+}
+
+/*
+Health - State of redis and the cold storage offload. Responds with
+503 if one of them is down. Reads are counted per tier, compression
+metrics are reported per codec. Encryption reports the active key and
+whether a requested rotation is still running on this instance.
+
+	# curl $API/health
+	{
+		"status": "ok",
+		"redis": "ok",
+		"offload": {
+			"online": true,
+			"since": "2016-05-01T10:00:00Z",
+			"last_error": "",
+			"reconnects": 0,
+			"notifications": true
+		},
+		"tiering": {
+			"policy": "fixed",
+			"hot_hits": 120,
+			"cold_hits": 4,
+			"misses": 0,
+			"promotions": 4,
+			"demotions": 9,
+			"hot_ratio": 0.967
+		},
+		"compression": {
+			"zstd": {
+				"encoded": 12,
+				"decoded": 130,
+				"bytes_in": 48211,
+				"bytes_out": 11873,
+				"ratio": 0.246,
+				"encode_us": 41.5,
+				"decode_us": 9.8
+			}
+		},
+		"encryption": {
+			"enabled": true,
+			"key": "2016-06",
+			"rotation": "2",
+			"pending": false
+		}
+	}
+*/
+func Health(c *gin.Context) {
+	status, code := "ok", 200
+	online, details := offload.status()
+	if !online {
+		status, code = "degraded", 503
+	}
+	redis := "ok"
+	if err := helper.RedisClient().Ping().Err(); err != nil {
+		redis = err.Error()
+		status, code = "unavailable", 503
+	}
+	tiering, err := models.TierStats()
+	if err != nil {
+		tiering = map[string]interface{}{"error": err.Error()}
+	}
+	encryption, err := models.EncryptionStats()
+	if err != nil {
+		encryption = map[string]interface{}{"error": err.Error()}
+	}
+	c.JSON(code, gin.H{
+		"status":      status,
+		"redis":       redis,
+		"offload":     details,
+		"tiering":     tiering,
+		"compression": helper.CodecStats(),
+		"encryption":  encryption,
+	})
+}
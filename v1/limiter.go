@@ -0,0 +1,195 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Window - State of a sliding window. The previous fixed window is
+// weighted by the part of it which still overlaps the sliding window.
+type Window struct {
+	Previous int64
+	Current  int64
+	Elapsed  time.Duration
+	Period   time.Duration
+}
+
+// Count returns the weighted amount within the sliding window.
+func (w Window) Count() int64 {
+	remaining := float64(w.Period-w.Elapsed) / float64(w.Period)
+	return int64(float64(w.Previous)*remaining) + w.Current
+}
+
+// Reset returns the time until the current fixed window ends.
+func (w Window) Reset() time.Duration {
+	return w.Period - w.Elapsed
+}
+
+// RetryAfter returns the time until the count drops to limit,
+// assuming no further hits.
+func (w Window) RetryAfter(limit int64) time.Duration {
+	if w.Count() <= limit {
+		return 0
+	}
+	if w.Current <= limit {
+		wait := float64(w.Reset()) - float64(limit-w.Current)*float64(w.Period)/float64(w.Previous)
+		return time.Duration(wait)
+	}
+	return w.Reset() + time.Duration(float64(w.Period)*(1-float64(limit)/float64(w.Current)))
+}
+
+// Limiter - Counts weighted hits per key in a sliding window.
+type Limiter interface {
+	// Hit adds weight to key and returns the resulting window.
+	Hit(key string, weight int64, period time.Duration) (Window, error)
+}
+
+func windowOf(now time.Time, period time.Duration) (int64, time.Duration) {
+	nanos := now.UnixNano()
+	return nanos / int64(period), time.Duration(nanos % int64(period))
+}
+
+var slidingWindow = redis.NewScript(`
+local current = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+return {previous, current}
+`)
+
+// RedisLimiter - Sliding window limiter shared by all instances.
+// Each fixed window is a counter, which is updated atomically by a script.
+type RedisLimiter struct{}
+
+// Hit - see Limiter
+func (l RedisLimiter) Hit(key string, weight int64, period time.Duration) (Window, error) {
+	index, elapsed := windowOf(time.Now(), period)
+	keys := []string{
+		key + "::" + strconv.FormatInt(index, 10),
+		key + "::" + strconv.FormatInt(index-1, 10),
+	}
+	args := []string{
+		strconv.FormatInt(weight, 10),
+		strconv.FormatInt(int64(2*period/time.Millisecond), 10),
+	}
+	result, err := slidingWindow.Run(helper.RedisClient(), keys, args).Result()
+	if err != nil {
+		return Window{}, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return Window{}, errors.New("unexpected ratelimit script result")
+	}
+	previous, _ := values[0].(int64)
+	current, _ := values[1].(int64)
+	return Window{
+		Previous: previous,
+		Current:  current,
+		Elapsed:  elapsed,
+		Period:   period,
+	}, nil
+}
+
+type memoryCounter struct {
+	index    int64
+	current  int64
+	previous int64
+}
+
+// MemoryLimiter - Sliding window limiter for a single instance.
+type MemoryLimiter struct {
+	sync.Mutex
+	counters map[string]*memoryCounter
+	hits     int
+}
+
+// NewMemoryLimiter returns an empty in-memory limiter.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		counters: map[string]*memoryCounter{},
+	}
+}
+
+// Hit - see Limiter
+func (l *MemoryLimiter) Hit(key string, weight int64, period time.Duration) (Window, error) {
+	index, elapsed := windowOf(time.Now(), period)
+	l.Lock()
+	defer l.Unlock()
+
+	l.hits++
+	if l.hits%10000 == 0 {
+		for k, counter := range l.counters {
+			if counter.index < index-1 {
+				delete(l.counters, k)
+			}
+		}
+	}
+
+	counter, found := l.counters[key]
+	if !found {
+		counter = &memoryCounter{index: index}
+		l.counters[key] = counter
+	}
+	if counter.index != index {
+		if counter.index == index-1 {
+			counter.previous = counter.current
+		} else {
+			counter.previous = 0
+		}
+		counter.index = index
+		counter.current = 0
+	}
+	counter.current += weight
+	return Window{
+		Previous: counter.previous,
+		Current:  counter.current,
+		Elapsed:  elapsed,
+		Period:   period,
+	}, nil
+}
+
+var (
+	limiter     Limiter
+	limiterOnce sync.Once
+)
+
+// ratelimiter returns the limiter configured by RATELIMIT_BACKEND
+// ("redis" - default, or "memory").
+func ratelimiter() Limiter {
+	limiterOnce.Do(func() {
+		if os.Getenv("RATELIMIT_BACKEND") == "memory" {
+			limiter = NewMemoryLimiter()
+		} else {
+			limiter = RedisLimiter{}
+		}
+	})
+	return limiter
+}
+
+// ratelimitPeriod returns the sliding window size set by
+// RATELIMIT_PERIOD, defaults to one hour.
+func ratelimitPeriod() time.Duration {
+	period, err := time.ParseDuration(os.Getenv("RATELIMIT_PERIOD"))
+	if err != nil || period <= 0 {
+		return time.Hour
+	}
+	return period
+}
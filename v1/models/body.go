@@ -0,0 +1,258 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"github.com/satori/go.uuid"
+	"gopkg.in/redis.v3"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrBodyLocked is returned if a body stays locked by another instance.
+var ErrBodyLocked = errors.New("body is locked")
+
+const (
+	bodyLockTimeout = 30 * time.Second
+	bodyLockRetries = 200
+	bodyLockDelay   = 10 * time.Millisecond
+)
+
+// releaseRef drops a reference of a body. It returns the remaining
+// references. With the last one, the counter and the body are removed
+// from redis along, so no snippet is able to reference it in between.
+var releaseRef = redis.NewScript(`
+local refs = redis.call('DECR', KEYS[1])
+if refs > 0 then
+	return refs
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[4])
+redis.call('ZREM', KEYS[5], ARGV[1])
+redis.call('ZREM', KEYS[6], ARGV[1])
+redis.call('SREM', KEYS[7], ARGV[1])
+redis.call('HDEL', KEYS[8], ARGV[1])
+return 0
+`)
+
+// unlockBody removes the lock of a body, if it's still held by the token.
+var unlockBody = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ContentHash returns the hex encoded SHA-256 of a paste, as reported
+// by the API.
+func ContentHash(paste string) string {
+	sum := sha256.Sum256([]byte(paste))
+	return hex.EncodeToString(sum[:])
+}
+
+// BodyID returns the id identical pastes share their body by. With a
+// keyring it is a fingerprint keyed by it, so equal pastes can't be
+// told apart from the storage, otherwise the content hash.
+func BodyID(paste string) (string, error) {
+	id, err := helper.Fingerprint(paste)
+	if err != nil || id != "" {
+		return id, err
+	}
+	return ContentHash(paste), nil
+}
+
+// snippetBody returns the id of the body a snippet references. Snippets
+// stored before ids were keyed hold it as hash, those stored before
+// bodies were shared hold their paste.
+func snippetBody(value map[string]string) string {
+	if id := value["body"]; id != "" {
+		return id
+	}
+	return value["hash"]
+}
+
+func bodyKey(id string) string {
+	return "bodies::" + id
+}
+
+func refsKey(id string) string {
+	return "refs::bodies::" + id
+}
+
+// lockBody serializes storing and removing a body, since both write
+// cold storage besides redis. The returned func releases the lock.
+func lockBody(id string) (func(), error) {
+	key := "lock::bodies::" + id
+	token := uuid.NewV4().String()
+	for i := 0; i < bodyLockRetries; i++ {
+		locked, err := helper.RedisClient().SetNX(key, token, bodyLockTimeout).Result()
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return func() {
+				unlockBody.Run(helper.RedisClient(), []string{key}, []string{token})
+			}, nil
+		}
+		time.Sleep(bodyLockDelay)
+	}
+	return nil, ErrBodyLocked
+}
+
+// bodyStored reports whether the body exists in redis or cold storage.
+func bodyStored(id string) (bool, error) {
+	hot, err := helper.RedisClient().Exists(bodyKey(id)).Result()
+	if err != nil || hot {
+		return hot, err
+	}
+	_, err = helper.ColdGet(bodyKey(id))
+	if err == helper.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// storeBody references the body of a paste and returns its id. The
+// body is only stored if no other snippet references it yet, it is
+// encrypted if a keyring is configured. The reference keeps the body
+// until the pipeline wrote it, callers release it if they fail.
+func storeBody(r *redis.Pipeline, paste string, pinned bool) (string, error) {
+	id, err := BodyID(paste)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := helper.Seal(helper.Zip(paste))
+	if err != nil {
+		return "", err
+	}
+	unlock, err := lockBody(id)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	refs, err := helper.RedisClient().Incr(refsKey(id)).Result()
+	if err != nil {
+		return "", err
+	}
+	stored := false
+	if refs > 1 {
+		stored, err = bodyStored(id)
+	}
+	if err == nil && !stored {
+		err = cacheBlob(r, bodyKey(id), sealed, pinned)
+	}
+	if err != nil {
+		if _, dropErr := dropRef(id); dropErr != nil {
+			log.Warn(dropErr, "Releasing reference of body "+id+" failed")
+		}
+		return "", err
+	}
+	if pinned {
+		pinKey(r, bodyKey(id))
+	}
+	return id, nil
+}
+
+// releaseBody drops a reference of a body and removes the body once
+// no snippet references it anymore.
+func releaseBody(id string) error {
+	unlock, err := lockBody(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	refs, err := dropRef(id)
+	if err != nil || refs != 0 {
+		return err
+	}
+	if err := helper.ColdDel(bodyKey(id)); err != nil && err != helper.ErrColdUnavailable {
+		return err
+	}
+	return nil
+}
+
+// dropRef drops a reference of a body while holding its lock. It
+// returns the remaining references.
+func dropRef(id string) (int64, error) {
+	key := bodyKey(id)
+	refs, err := releaseRef.Run(helper.RedisClient(), []string{
+		refsKey(id), key, "shadow::" + key, "tier::hits::" + key,
+		OffloadQueue, OffloadClaims, pinnedKeys, pinCounts,
+	}, []string{key}).Result()
+	if err != nil {
+		return 0, err
+	}
+	remaining, _ := refs.(int64)
+	return remaining, nil
+}
+
+// releaseBodies rolls back the references of bodies stored by a
+// failed write.
+func releaseBodies(ids []string) {
+	for _, id := range ids {
+		if err := releaseBody(id); err != nil {
+			log.Warn(err, "Releasing body "+id+" failed")
+		}
+	}
+}
+
+// loadBody returns the decrypted, still compressed body.
+func loadBody(id string, cmd *redis.StringCmd) (string, error) {
+	blob, err := loadBlob(bodyKey(id), cmd)
+	if err != nil {
+		return "", err
+	}
+	return helper.Open(blob)
+}
+
+// loadBodies fills in the pastes and content hashes of snippets, which
+// reference a body.
+func loadBodies(snippets map[string]map[string]string) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	bodies := map[string]*redis.StringCmd{}
+	for _, value := range snippets {
+		if id := snippetBody(value); id != "" && bodies[id] == nil {
+			bodies[id] = pipe.Get(bodyKey(id))
+		}
+	}
+	if len(bodies) == 0 {
+		return nil
+	}
+	if err := execPipeline(pipe); err != nil {
+		return err
+	}
+	pastes := map[string]string{}
+	for id, cmd := range bodies {
+		blob, err := loadBody(id, cmd)
+		if err != nil {
+			return err
+		}
+		if pastes[id], err = helper.Unzip(blob); err != nil {
+			return err
+		}
+	}
+	for _, value := range snippets {
+		if id := snippetBody(value); id != "" {
+			delete(value, "body")
+			value["paste"] = pastes[id]
+			value["hash"] = ContentHash(pastes[id])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"github.com/satori/go.uuid"
+	"gopkg.in/redis.v3"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var tagFormat = regexp.MustCompile(`^[a-z0-9_.-]{1,50}$`)
+
+// ErrTagInvalid is returned for tags not matching the allowed format.
+var ErrTagInvalid = errors.New("tags must be 1-50 lowercase letters, digits, '_', '.' or '-'")
+
+func (u *User) keyTags() string {
+	return "users::" + u.UUID + "::tags"
+}
+
+func (u *User) keyTag(tag string) string {
+	return "users::" + u.UUID + "::tags::" + tag
+}
+
+func (u *User) keyGistTags(gist string) string {
+	return "users::" + u.UUID + "::gisttags::" + gist
+}
+
+func (u *User) keyCollections() string {
+	return "users::" + u.UUID + "::collections"
+}
+
+func keyCollectionGists(id string) string {
+	return "collections::" + id + "::gists"
+}
+
+func sorted(list []string, err error) ([]string, error) {
+	sort.Strings(list)
+	return list, err
+}
+
+// NormalizeTag lowercases a tag and verifies its format.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagFormat.MatchString(tag) {
+		return "", ErrTagInvalid
+	}
+	return tag, nil
+}
+
+// Tags returns all tags used by the user.
+func (u *User) Tags() ([]string, error) {
+	return sorted(helper.RedisClient().SMembers(u.keyTags()).Result())
+}
+
+// TagGist adds tags to a gist.
+func (u *User) TagGist(gist string, tags []string) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	for _, tag := range tags {
+		pipe.SAdd(u.keyTags(), tag)
+		pipe.SAdd(u.keyTag(tag), gist)
+		pipe.SAdd(u.keyGistTags(gist), tag)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// UntagGist removes a tag from a gist. Unused tags are dropped.
+func (u *User) UntagGist(gist string, tag string) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	pipe.SRem(u.keyTag(tag), gist)
+	pipe.SRem(u.keyGistTags(gist), tag)
+	remaining := pipe.SCard(u.keyTag(tag))
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	if remaining.Val() == 0 {
+		return helper.RedisClient().SRem(u.keyTags(), tag).Err()
+	}
+	return nil
+}
+
+// GistTags returns the tags the user assigned to a gist.
+func (u *User) GistTags(gist string) ([]string, error) {
+	return sorted(helper.RedisClient().SMembers(u.keyGistTags(gist)).Result())
+}
+
+// TaggedGists returns all gists tagged with tag.
+func (u *User) TaggedGists(tag string) ([]string, error) {
+	return sorted(helper.RedisClient().SMembers(u.keyTag(tag)).Result())
+}
+
+// Collections returns a map of collection ids and names.
+func (u *User) Collections() (map[string]string, error) {
+	return helper.RedisClient().HGetAllMap(u.keyCollections()).Result()
+}
+
+// CreateCollection creates a new named collection and returns its id.
+func (u *User) CreateCollection(name string) (string, error) {
+	id := uuid.NewV4().String()
+	return id, helper.RedisClient().HSet(u.keyCollections(), id, name).Err()
+}
+
+// CollectionName returns the name of a collection of the user.
+func (u *User) CollectionName(id string) (string, bool, error) {
+	name, err := helper.RedisClient().HGet(u.keyCollections(), id).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	return name, err == nil, err
+}
+
+// DeleteCollection removes a collection. The gists itself are kept.
+func (u *User) DeleteCollection(id string) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	pipe.HDel(u.keyCollections(), id)
+	pipe.Del(keyCollectionGists(id))
+	_, err := pipe.Exec()
+	return err
+}
+
+// CollectionGists returns the gists of a collection.
+func CollectionGists(id string) ([]string, error) {
+	return sorted(helper.RedisClient().SMembers(keyCollectionGists(id)).Result())
+}
+
+// AddToCollection adds a gist to a collection.
+func AddToCollection(id string, gist string) error {
+	return helper.RedisClient().SAdd(keyCollectionGists(id), gist).Err()
+}
+
+// RemoveFromCollection removes a gist from a collection.
+func RemoveFromCollection(id string, gist string) error {
+	return helper.RedisClient().SRem(keyCollectionGists(id), gist).Err()
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"github.com/muhproductions/muh/helper"
+	"github.com/satori/go.uuid"
+	"gopkg.in/redis.v3"
+	"time"
+)
+
+func (g *Gist) keyComments() string {
+	return "gists::" + g.UUID + "::comments"
+}
+
+// AddComment stores a new comment. The comment is stored like
+// snippets, compressed in redis and offloaded into cold storage.
+func (g *Gist) AddComment(comment map[string]string) (map[string]string, error) {
+	now := time.Now()
+	comment["uuid"] = uuid.NewV4().String()
+	comment["gist"] = g.UUID
+	comment["created_at"] = now.UTC().Format(time.RFC3339)
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	if err := cacheValue(pipe, "comments::"+comment["uuid"], comment, false); err != nil {
+		return nil, err
+	}
+	pipe.ZAdd(g.keyComments(), redis.Z{
+		Score:  float64(now.UnixNano()),
+		Member: comment["uuid"],
+	})
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// GetComments returns all comments of the gist ordered by creation.
+func (g *Gist) GetComments() ([]map[string]string, error) {
+	ids, err := helper.RedisClient().ZRangeByScore(g.keyComments(), redis.ZRangeByScore{
+		Min: "-inf",
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	comments := []map[string]string{}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	values := []*redis.StringCmd{}
+	for _, id := range ids {
+		values = append(values, pipe.Get("comments::"+id))
+	}
+	if err := execPipeline(pipe); err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		comment, err := loadValue("comments::"+id, values[i])
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+// GetComment returns a single comment of the gist.
+func (g *Gist) GetComment(id string) (map[string]string, bool, error) {
+	err := helper.RedisClient().ZScore(g.keyComments(), id).Err()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	comment, err := loadValue("comments::"+id, helper.RedisClient().Get("comments::"+id))
+	return comment, err == nil, err
+}
+
+// DeleteComment removes a comment of the gist.
+func (g *Gist) DeleteComment(id string) error {
+	if err := helper.RedisClient().ZRem(g.keyComments(), id).Err(); err != nil {
+		return err
+	}
+	return deleteValue("comments::" + id)
+}
@@ -15,12 +15,15 @@
 package models
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"errors"
 	"github.com/muhproductions/muh/helper"
 	"github.com/satori/go.uuid"
 	"gopkg.in/redis.v3"
+	"math/big"
 	"os"
-	"time"
+	"regexp"
+	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -30,13 +33,32 @@ type Gist struct {
 	UUID string
 }
 
-//Exists verifies the persistence level.
-func (g *Gist) Exists() bool {
-	val, err := helper.RedisClient().Exists("gists::" + g.UUID).Result()
-	if err != nil {
-		return false
+const defaultIDAlphabet = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+var slugFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,63}$`)
+
+var (
+	// ErrSlugInvalid is returned for slugs not matching the allowed format.
+	ErrSlugInvalid = errors.New("slug must be 3-64 lowercase letters, digits or dashes")
+	// ErrSlugTaken is returned if a slug or id is already in use.
+	ErrSlugTaken = errors.New("slug already taken")
+)
+
+// ResolveGist returns the gist for an uuid, short id or slug.
+func ResolveGist(id string) (Gist, error) {
+	target, err := helper.RedisClient().Get("gists::ids::" + id).Result()
+	if err != nil && err != redis.Nil {
+		return Gist{UUID: id}, err
 	}
-	return val
+	if target != "" {
+		return Gist{UUID: target}, nil
+	}
+	return Gist{UUID: id}, nil
+}
+
+//Exists verifies the persistence level.
+func (g *Gist) Exists() (bool, error) {
+	return helper.RedisClient().Exists("gists::" + g.UUID).Result()
 }
 
 type snippet struct {
@@ -44,35 +66,38 @@ type snippet struct {
 	Value map[string]string
 }
 
-func (snippet *snippet) cacheSnippet(r *redis.Pipeline) {
-	json, _ := json.Marshal(snippet.Value)
-	expire, _ := time.ParseDuration("1h")
-	if os.Getenv("CACHING_TIME") != "" {
-		t, err := time.ParseDuration(os.Getenv("CACHING_TIME"))
-		if err != nil {
-			expire = t
-		}
-	}
-	r.Set("shadow::snippets::"+snippet.UUID, "", expire)
-	r.Set("snippets::"+snippet.UUID, helper.Zip(string(json)), 0)
+func (snippet *snippet) cacheSnippet(r *redis.Pipeline, pinned bool) error {
+	return cacheValue(r, "snippets::"+snippet.UUID, snippet.Value, pinned)
 }
 
-func getSnippet(r *redis.Pipeline, key string, value *redis.StringCmd) snippet {
-	snipp := snippet{
-		UUID: key,
+// storeSnippet stores the paste of a snippet as shared body, the
+// snippet itself only keeps the id of the body.
+func (snippet *snippet) storeSnippet(r *redis.Pipeline, pinned bool) error {
+	value := map[string]string{}
+	for k, v := range snippet.Value {
+		value[k] = v
 	}
-	val, err := value.Result()
-	var dat map[string]string
+	id, err := storeBody(r, value["paste"], pinned)
 	if err != nil {
-		json.Unmarshal([]byte(helper.Unzip(helper.BoltGet("snippets::"+key))), &dat)
-		snipp.Value = dat
-		snipp.cacheSnippet(r)
-		helper.BoltDel("snippets::" + key)
-	} else {
-		json.Unmarshal([]byte(helper.Unzip(val)), &dat)
+		return err
+	}
+	delete(value, "paste")
+	delete(value, "hash")
+	value["body"] = id
+	snippet.Value = value
+	if err := snippet.cacheSnippet(r, pinned); err != nil {
+		releaseBodies([]string{id})
+		return err
 	}
-	snipp.Value = dat
-	return snipp
+	return nil
+}
+
+func getSnippet(key string, value *redis.StringCmd) (snippet, error) {
+	dat, err := loadValue("snippets::"+key, value)
+	return snippet{
+		UUID:  key,
+		Value: dat,
+	}, err
 }
 
 func (g *Gist) initSnippet(r *redis.Pipeline, snippet snippet, userid string) {
@@ -83,44 +108,252 @@ func (g *Gist) initSnippet(r *redis.Pipeline, snippet snippet, userid string) {
 }
 
 // SetupUUID defines a new UUID unless set.
+// A short random id is used if GIST_ID_LENGTH is set.
 func (g *Gist) SetupUUID() {
-	if g.UUID == "" {
-		g.UUID = uuid.NewV4().String()
+	if g.UUID != "" {
+		return
+	}
+	length, _ := strconv.Atoi(os.Getenv("GIST_ID_LENGTH"))
+	if length > 0 {
+		alphabet := os.Getenv("GIST_ID_ALPHABET")
+		if alphabet == "" {
+			alphabet = defaultIDAlphabet
+		}
+		for i := 0; i < 10; i++ {
+			id := randomID(length, alphabet)
+			exists, err := (&Gist{UUID: id}).Exists()
+			reserved := false
+			if err == nil && !exists {
+				reserved, err = reserveID(id, id)
+			}
+			if err != nil {
+				log.Warn(err, "Reserving short gist id failed")
+				break
+			}
+			if reserved {
+				g.UUID = id
+				return
+			}
+		}
+		log.Warn("No free short gist id found, falling back to uuid")
+	}
+	g.UUID = uuid.NewV4().String()
+}
+
+func randomID(length int, alphabet string) string {
+	id := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range id {
+		n, _ := rand.Int(rand.Reader, max)
+		id[i] = alphabet[n.Int64()]
 	}
+	return string(id)
+}
+
+func reserveID(id string, target string) (bool, error) {
+	return helper.RedisClient().SetNX("gists::ids::"+id, target, 0).Result()
+}
+
+// OwnedBy verifies that the gist was created by the given user.
+func (g *Gist) OwnedBy(userid string) (bool, error) {
+	if userid == "" {
+		return false, nil
+	}
+	return helper.RedisClient().Exists("users::" + userid + "::gists::" + g.UUID).Result()
+}
+
+// Slug returns the vanity slug of the gist, if any.
+func (g *Gist) Slug() (string, error) {
+	slug, err := helper.RedisClient().Get("gists::" + g.UUID + "::slug").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return slug, err
+}
+
+// SetSlug assigns a vanity slug to the gist and releases the previous one.
+func (g *Gist) SetSlug(slug string) error {
+	if !slugFormat.MatchString(slug) {
+		return ErrSlugInvalid
+	}
+	taken, err := (&Gist{UUID: slug}).Exists()
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrSlugTaken
+	}
+	reserved, err := reserveID(slug, g.UUID)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		owner, err := ResolveGist(slug)
+		if err != nil {
+			return err
+		}
+		if owner.UUID != g.UUID {
+			return ErrSlugTaken
+		}
+	}
+	old, err := g.Slug()
+	if err != nil {
+		return err
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	pipe.Set("gists::"+g.UUID+"::slug", slug, 0)
+	if old != "" && old != slug {
+		pipe.Del("gists::ids::" + old)
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// RemoveSlug releases the vanity slug of the gist.
+func (g *Gist) RemoveSlug() error {
+	slug, err := g.Slug()
+	if err != nil || slug == "" {
+		return err
+	}
+	return helper.RedisClient().Del("gists::ids::"+slug, "gists::"+g.UUID+"::slug").Err()
 }
 
 //AddSnippets appends new compressed snippets.
-func (g *Gist) AddSnippets(snippets []map[string]string, userid string) bool {
+func (g *Gist) AddSnippets(snippets []map[string]string, userid string) error {
 	pipe := helper.RedisClient().Pipeline()
 	defer pipe.Close()
+	pinned := false
+	if g.UUID != "" {
+		var err error
+		if pinned, err = g.Pinned(); err != nil {
+			return err
+		}
+	}
 	g.SetupUUID()
+	ids := []string{}
 	for _, v := range snippets {
 		s := snippet{UUID: uuid.NewV4().String(), Value: v}
+		if pinned {
+			pinKey(pipe, "snippets::"+s.UUID)
+		}
+		if err := s.storeSnippet(pipe, pinned); err != nil {
+			releaseBodies(ids)
+			return err
+		}
+		ids = append(ids, s.Value["body"])
 		g.initSnippet(pipe, s, userid)
-		s.cacheSnippet(pipe)
 	}
-	pipe.Exec()
-	return true
+	if _, err := pipe.Exec(); err != nil {
+		releaseBodies(ids)
+		return err
+	}
+	return nil
 }
 
 //GetSnippets returns all uncompressed snippets which are associated to self.
-func (g *Gist) GetSnippets() map[string]map[string]string {
+func (g *Gist) GetSnippets() (map[string]map[string]string, error) {
+	snippetscollection, err := g.snippetValues()
+	if err != nil {
+		return nil, err
+	}
+	if err := loadBodies(snippetscollection); err != nil {
+		return nil, err
+	}
+	return snippetscollection, nil
+}
+
+// snippetValues returns the snippets of the gist without their pastes.
+func (g *Gist) snippetValues() (map[string]map[string]string, error) {
 	snippets, err := helper.RedisClient().SMembers("gists::" + g.UUID).Result()
 	snippetsprecollection := map[string]*redis.StringCmd{}
 	snippetscollection := map[string]map[string]string{}
 	if err != nil {
-		log.Error(err, "Gist not found")
-	} else {
-		pipe := helper.RedisClient().Pipeline()
-		defer pipe.Close()
-		for _, snipp := range snippets {
-			snippetsprecollection[snipp] = pipe.Get("snippets::" + snipp)
+		return nil, err
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	for _, snipp := range snippets {
+		snippetsprecollection[snipp] = pipe.Get("snippets::" + snipp)
+	}
+	if err := execPipeline(pipe); err != nil {
+		return nil, err
+	}
+	for k, v := range snippetsprecollection {
+		snipp, err := getSnippet(k, v)
+		if err != nil {
+			return nil, err
 		}
-		pipe.Exec()
-		for k, v := range snippetsprecollection {
-			snippetscollection[k] = getSnippet(pipe, k, v).Value
+		snippetscollection[k] = snipp.Value
+	}
+	return snippetscollection, nil
+}
+
+// SnippetCount returns the amount of snippets of the gist.
+func (g *Gist) SnippetCount() (int64, error) {
+	return helper.RedisClient().SCard("gists::" + g.UUID).Result()
+}
+
+// GetPaste returns the compressed body of a snippet. Snippets stored
+// before bodies were shared aren't reported as stored.
+func (g *Gist) GetPaste(id string) (string, bool, error) {
+	value, found, err := g.snippetValue(id)
+	body := snippetBody(value)
+	if err != nil || !found || body == "" {
+		return "", false, err
+	}
+	blob, err := loadBody(body, helper.RedisClient().Get(bodyKey(body)))
+	return blob, err == nil, err
+}
+
+// GetSnippet returns a single uncompressed snippet of the gist.
+func (g *Gist) GetSnippet(id string) (map[string]string, bool, error) {
+	value, found, err := g.snippetValue(id)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if err := loadBodies(map[string]map[string]string{id: value}); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// snippetValue returns a single snippet of the gist without its paste.
+func (g *Gist) snippetValue(id string) (map[string]string, bool, error) {
+	member, err := helper.RedisClient().SIsMember("gists::"+g.UUID, id).Result()
+	if err != nil || !member {
+		return nil, false, err
+	}
+	snipp, err := getSnippet(id, helper.RedisClient().Get("snippets::"+id))
+	return snipp.Value, err == nil, err
+}
+
+// DeleteSnippet removes a snippet from the gist. Its body is removed
+// once no other snippet shares it, and unpinned once no other pinned
+// gist shares it.
+func (g *Gist) DeleteSnippet(id string) error {
+	value, found, err := g.snippetValue(id)
+	if err != nil || !found {
+		return err
+	}
+	if err := helper.RedisClient().SRem("gists::"+g.UUID, id).Err(); err != nil {
+		return err
+	}
+	if err := deleteValue("snippets::" + id); err != nil {
+		return err
+	}
+	body := snippetBody(value)
+	if body == "" {
+		return nil
+	}
+	pinned, err := g.Pinned()
+	if err != nil {
+		return err
+	}
+	if pinned {
+		if err := g.unpin("keys", []string{bodyKey(body)}); err != nil {
+			return err
 		}
-		pipe.Exec()
 	}
-	return snippetscollection
+	return releaseBody(body)
 }
@@ -0,0 +1,200 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+	"os"
+	"strconv"
+	"time"
+)
+
+// OffloadQueue - Sorted set of cached keys, scored by the unix time
+// they are due to be moved into cold storage.
+const OffloadQueue = "offload::due"
+
+// OffloadClaims - Sorted set of keys claimed by an instance, scored by
+// the unix time the claim times out.
+const OffloadClaims = "offload::processing"
+
+// offloadRetry delays the next attempt of a failed offload.
+const offloadRetry = time.Minute
+
+// ErrOffloadVerify is returned if the cold copy differs from the cached value.
+var ErrOffloadVerify = errors.New("cold copy doesn't match the cached value")
+
+// claimOffload moves a key from the queue to the claims, unless another
+// instance holds a claim which didn't time out yet. The key leaves the
+// queue either way, the claiming instance queues it again if needed.
+var claimOffload = redis.NewScript(`
+local claim = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if claim and tonumber(claim) > tonumber(ARGV[2]) then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+return 1
+`)
+
+// finishOffload releases the claim and removes the value from redis,
+// once it is stored cold. Values cached again or changed meanwhile are
+// kept and queued again.
+var finishOffload = redis.NewScript(`
+redis.call('ZREM', KEYS[4], ARGV[2])
+local ttl = redis.call('PTTL', KEYS[2])
+if ttl >= 0 then
+	redis.call('ZADD', KEYS[3], tonumber(ARGV[3]) + math.floor(ttl / 1000), ARGV[2])
+	return 0
+end
+if ttl == -1 then
+	return 0
+end
+local value = redis.call('GET', KEYS[1])
+if value and value ~= ARGV[1] then
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[2])
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// OffloadClaimTimeout returns how long a claim is exclusive, set by
+// OFFLOAD_CLAIM_TIMEOUT. Keys of crashed instances are offloaded by
+// others after it. Defaults to five minutes.
+func OffloadClaimTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("OFFLOAD_CLAIM_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 5 * time.Minute
+	}
+	return timeout
+}
+
+func unix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// claim reports whether this instance may offload the key.
+func claim(key string) (bool, error) {
+	now := time.Now()
+	claimed, err := claimOffload.Run(helper.RedisClient(), []string{OffloadQueue, OffloadClaims}, []string{
+		key,
+		unix(now),
+		unix(now.Add(OffloadClaimTimeout())),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	return claimed == int64(1), nil
+}
+
+// enqueueOffload schedules the offload of a cached key.
+func enqueueOffload(r *redis.Pipeline, key string, due time.Time) {
+	r.ZAdd(OffloadQueue, redis.Z{Score: float64(due.Unix()), Member: key})
+}
+
+// retryOffload releases the claim, reschedules the offload and passes
+// its error on.
+func retryOffload(key string, err error) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	pipe.ZRem(OffloadClaims, key)
+	enqueueOffload(pipe, key, time.Now().Add(offloadRetry))
+	execPipeline(pipe)
+	return err
+}
+
+// Offload moves a cached value, whose shadow key expired, into cold
+// storage. Only the instance claiming the key offloads it. The value
+// is only removed from redis after the cold copy was written and read
+// back, otherwise the key is queued again. Running it twice for a key
+// is harmless.
+func Offload(key string) error {
+	r := helper.RedisClient()
+	ttl, err := r.PTTL("shadow::" + key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		pipe := r.Pipeline()
+		defer pipe.Close()
+		enqueueOffload(pipe, key, time.Now().Add(ttl))
+		return execPipeline(pipe)
+	}
+	if ttl == -time.Millisecond {
+		return r.ZRem(OffloadQueue, key).Err()
+	}
+	retained, err := retain(key)
+	if err != nil || retained {
+		return err
+	}
+	claimed, err := claim(key)
+	if err != nil || !claimed {
+		return err
+	}
+	value, err := r.Get(key).Result()
+	if err == redis.Nil {
+		return r.ZRem(OffloadClaims, key).Err()
+	}
+	if err != nil {
+		return retryOffload(key, err)
+	}
+	if err := helper.ColdSet(key, value); err != nil {
+		return retryOffload(key, err)
+	}
+	stored, err := helper.ColdGet(key)
+	if err != nil {
+		return retryOffload(key, err)
+	}
+	if stored != value {
+		return retryOffload(key, ErrOffloadVerify)
+	}
+	dropped, err := finishOffload.Run(r, []string{key, "shadow::" + key, OffloadQueue, OffloadClaims}, []string{
+		value,
+		key,
+		unix(time.Now()),
+	}).Result()
+	if err == nil && dropped == int64(1) {
+		countTier("demotions")
+	}
+	return err
+}
+
+// OffloadDue offloads up to limit queued keys, which are due, and keys
+// whose claim timed out. Failed keys are retried later, their errors
+// are returned.
+func OffloadDue(limit int64) (int, []error) {
+	var keys []string
+	for _, set := range []string{OffloadClaims, OffloadQueue} {
+		due, err := helper.RedisClient().ZRangeByScore(set, redis.ZRangeByScore{
+			Min:   "-inf",
+			Max:   unix(time.Now()),
+			Count: limit,
+		}).Result()
+		if err != nil {
+			return 0, []error{err}
+		}
+		keys = append(keys, due...)
+	}
+	var errs []error
+	for _, key := range keys {
+		if err := Offload(key); err != nil {
+			errs = append(errs, errors.New(key+": "+err.Error()))
+		}
+	}
+	return len(keys) - len(errs), errs
+}
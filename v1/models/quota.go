@@ -0,0 +1,88 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+	"os"
+	"strconv"
+)
+
+// ErrStorageQuota is returned if storing would exceed the quota of a user.
+var ErrStorageQuota = errors.New("storage quota exceeded")
+
+var reserveStorage = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+local quota = tonumber(ARGV[2])
+if quota > 0 and used + tonumber(ARGV[1]) > quota then
+	return -1
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`)
+
+var releaseStorage = redis.NewScript(`
+local used = redis.call('DECRBY', KEYS[1], ARGV[1])
+if used < 0 then
+	redis.call('SET', KEYS[1], 0)
+	return 0
+end
+return used
+`)
+
+// StorageQuota returns the bytes each user may store, set by
+// STORAGE_QUOTA. 0 means unlimited.
+func StorageQuota() int64 {
+	quota, _ := strconv.ParseInt(os.Getenv("STORAGE_QUOTA"), 10, 64)
+	return quota
+}
+
+func (u *User) keyStorage() string {
+	return "users::" + u.UUID + "::storage"
+}
+
+// StorageUsed returns the paste bytes stored by the user.
+func (u *User) StorageUsed() (int64, error) {
+	used, err := helper.RedisClient().Get(u.keyStorage()).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return used, err
+}
+
+// ReserveStorage accounts bytes to the user, unless the quota
+// would be exceeded.
+func (u *User) ReserveStorage(bytes int64) error {
+	used, err := reserveStorage.Run(helper.RedisClient(), []string{u.keyStorage()}, []string{
+		strconv.FormatInt(bytes, 10),
+		strconv.FormatInt(StorageQuota(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if used == int64(-1) {
+		return ErrStorageQuota
+	}
+	return nil
+}
+
+// ReleaseStorage returns bytes of the user, regardless of the quota.
+// The usage doesn't drop below zero.
+func (u *User) ReleaseStorage(bytes int64) error {
+	return releaseStorage.Run(helper.RedisClient(), []string{u.keyStorage()}, []string{
+		strconv.FormatInt(bytes, 10),
+	}).Err()
+}
@@ -0,0 +1,312 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package models
+
+import (
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+)
+
+// RotationRequest - Counter of requested key rotations. Instances
+// re-encrypt the bodies in redis and their cold storage once it grows.
+const RotationRequest = "crypt::rotation"
+
+// rotationDone is the rotation last finished along with the key it
+// sealed by, kept in the cold storage as every instance might have its own.
+const rotationDone = "crypt::rotated"
+
+// swapValue replaces a value, unless it changed meanwhile.
+var swapValue = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// rewriter rewrites a blob of key. write replaces it, unless it changed
+// meanwhile. It reports whether the blob was replaced.
+type rewriter func(key, blob string, write func(string) (bool, error)) (bool, error)
+
+// RequestRotation asks all instances to re-encrypt existing bodies by
+// the active key. It returns the number of the rotation.
+func RequestRotation() (int64, error) {
+	if _, err := helper.ActiveKeyID(); err != nil {
+		return 0, err
+	}
+	return helper.RedisClient().Incr(RotationRequest).Result()
+}
+
+// reseal encrypts a blob by the active key, changed is false if it
+// already is.
+func reseal(blob string) (string, bool, error) {
+	active, err := helper.ActiveKeyID()
+	if err != nil {
+		return "", false, err
+	}
+	if helper.SealedBy(blob) == active {
+		return blob, false, nil
+	}
+	opened, err := helper.Open(blob)
+	if err != nil {
+		return "", false, err
+	}
+	sealed, err := helper.Seal(opened)
+	return sealed, err == nil, err
+}
+
+// resealBlob encrypts a body by the active key.
+func resealBlob(key, blob string, write func(string) (bool, error)) (bool, error) {
+	sealed, changed, err := reseal(blob)
+	if err != nil || !changed {
+		return false, err
+	}
+	return write(sealed)
+}
+
+// peekBody returns the paste of a body, without caching it in redis
+// again if it's cold.
+func peekBody(id string) (string, error) {
+	blob, err := helper.RedisClient().Get(bodyKey(id)).Result()
+	if err == redis.Nil {
+		blob, err = helper.ColdGet(bodyKey(id))
+	}
+	if err != nil {
+		return "", err
+	}
+	if blob, err = helper.Open(blob); err != nil {
+		return "", err
+	}
+	return helper.Unzip(blob)
+}
+
+// migrateSnippet moves the paste of a snippet into the body BodyID
+// returns for it by now. This covers pastes of snippets stored before
+// bodies were shared, as well as bodies stored before encryption or
+// by a previous fingerprint key. The new body is released again, if
+// the snippet changed meanwhile, the previous one once it's replaced.
+func migrateSnippet(key, blob string, write func(string) (bool, error)) (bool, error) {
+	value, err := decodeValue(blob)
+	if err != nil {
+		return false, err
+	}
+	paste, inline := value["paste"]
+	previous := snippetBody(value)
+	if previous != "" {
+		if paste, err = peekBody(previous); err != nil {
+			return false, err
+		}
+	} else if !inline {
+		return false, nil
+	}
+	id, err := BodyID(paste)
+	if err != nil || id == previous {
+		return false, err
+	}
+	pinned, err := isPinned(key)
+	if err != nil {
+		return false, err
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	if id, err = storeBody(pipe, paste, pinned); err != nil {
+		return false, err
+	}
+	if err := execPipeline(pipe); err != nil {
+		releaseBodies([]string{id})
+		return false, err
+	}
+	delete(value, "paste")
+	delete(value, "hash")
+	value["body"] = id
+	encoded, err := encodeValue(value)
+	written := false
+	if err == nil {
+		written, err = write(encoded)
+	}
+	if err != nil || !written {
+		releaseBodies([]string{id})
+		return written, err
+	}
+	if previous == "" {
+		return true, nil
+	}
+	if pinned {
+		// The gist of the snippet is unknown, the pin of the previous body
+		// is dropped by key only.
+		if err := (&Gist{}).unpin("keys", []string{bodyKey(previous)}); err != nil {
+			return true, err
+		}
+	}
+	return true, releaseBody(previous)
+}
+
+// rewriteAll runs rewrite for the values of a prefix in redis and the
+// cold storage. Failed values are skipped, their errors are returned.
+func rewriteAll(prefix string, rewrite rewriter) (int, []error) {
+	r := helper.RedisClient()
+	rewritten := 0
+	var errs []error
+	fail := func(key string, err error) {
+		errs = append(errs, errors.New(key+": "+err.Error()))
+	}
+	var cursor int64
+	for {
+		next, keys, err := r.Scan(cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return rewritten, append(errs, err)
+		}
+		for _, key := range keys {
+			blob, err := r.Get(key).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+			written, err := rewrite(key, blob, func(value string) (bool, error) {
+				swapped, err := swapValue.Run(r, []string{key}, []string{blob, value}).Result()
+				return swapped == int64(1), err
+			})
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+			if written {
+				rewritten++
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	keys, err := helper.ColdKeys(prefix)
+	if err != nil {
+		return rewritten, append(errs, err)
+	}
+	for _, key := range keys {
+		blob, err := helper.ColdGet(key)
+		if err == helper.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			fail(key, err)
+			continue
+		}
+		written, err := rewrite(key, blob, func(value string) (bool, error) {
+			return helper.ColdCompareAndSet(key, blob, value)
+		})
+		if err != nil {
+			fail(key, err)
+			continue
+		}
+		if written {
+			rewritten++
+		}
+	}
+	return rewritten, errs
+}
+
+// Reencrypt seals all bodies in redis and the cold storage, which
+// aren't sealed by the active key yet. Unencrypted bodies are encrypted,
+// as are pastes of snippets stored before bodies were shared, which are
+// moved into bodies. Bodies whose id isn't the fingerprint of their
+// paste are stored under it once more, so equal pastes share them. Values changed or removed meanwhile are left alone.
+// Failed values are skipped, their errors are returned.
+func Reencrypt() (int, []error) {
+	migrated, errs := rewriteAll("snippets::", migrateSnippet)
+	resealed, bodyErrs := rewriteAll(bodyKey(""), resealBlob)
+	return migrated + resealed, append(errs, bodyErrs...)
+}
+
+// rotationMark identifies a rotation finished by the active key.
+func rotationMark(requested, active string) string {
+	return requested + ":" + active
+}
+
+// rotationPending reports whether the requested rotation wasn't finished
+// by the active key yet.
+func rotationPending(requested, done, active string) bool {
+	return requested != "" && rotationMark(requested, active) != done
+}
+
+// rotation returns the rotation requested last and the one finished by
+// the cold storage.
+func rotation() (string, string, error) {
+	requested, err := helper.RedisClient().Get(RotationRequest).Result()
+	if err != nil && err != redis.Nil {
+		return "", "", err
+	}
+	done, err := helper.ColdGet(rotationDone)
+	if err != nil && err != helper.ErrNotFound {
+		return "", "", err
+	}
+	return requested, done, nil
+}
+
+// RotateKeys runs Reencrypt, if a rotation was requested since the last
+// one finished or the active key changed since. The keyring is loaded
+// again first. A rotation with failed bodies is retried by the next run,
+// as is one during which the active key changed.
+func RotateKeys() (int, []error) {
+	requested, done, err := rotation()
+	if err != nil {
+		return 0, []error{err}
+	}
+	helper.ReloadKeyring()
+	active, err := helper.ActiveKeyID()
+	if err != nil {
+		return 0, []error{err}
+	}
+	if !rotationPending(requested, done, active) {
+		return 0, nil
+	}
+	resealed, errs := Reencrypt()
+	if len(errs) > 0 {
+		return resealed, errs
+	}
+	current, err := helper.ActiveKeyID()
+	if err != nil {
+		return resealed, []error{err}
+	}
+	if current != active {
+		return resealed, nil
+	}
+	if err := helper.ColdSet(rotationDone, rotationMark(requested, active)); err != nil {
+		return resealed, []error{err}
+	}
+	return resealed, nil
+}
+
+// EncryptionStats returns the active key and whether a requested
+// rotation is pending for this instance.
+func EncryptionStats() (map[string]interface{}, error) {
+	active, err := helper.ActiveKeyID()
+	if err != nil {
+		return nil, err
+	}
+	requested, done, err := rotation()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"enabled":  active != "",
+		"key":      active,
+		"rotation": requested,
+		"pending":  rotationPending(requested, done, active),
+	}, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CachedPrefixes - Key prefixes of values stored by cacheBlob
+var CachedPrefixes = []string{"snippets::", "comments::", "bodies::"}
+
+// cacheValue stores a compressed value in redis.
+func cacheValue(r *redis.Pipeline, key string, value map[string]string, pinned bool) error {
+	encoded, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+	return cacheBlob(r, key, encoded, pinned)
+}
+
+// encodeValue compresses the json of a value.
+func encodeValue(value map[string]string) (string, error) {
+	json, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return helper.Zip(string(json)), nil
+}
+
+// cacheBlob stores a compressed blob in redis. A shadow key expires
+// after CACHING_TIME, which moves the blob into cold storage. The key
+// is queued as well, in case the expired event gets lost. Pinned blobs
+// never expire, blobs above HOT_MAX_BYTES are stored cold right away.
+func cacheBlob(r *redis.Pipeline, key string, zipped string, pinned bool) error {
+	if !hot(len(zipped), pinned) {
+		err := helper.ColdSet(key, zipped)
+		if err == nil {
+			r.Del(key, "shadow::"+key)
+			return nil
+		}
+		log.Warn(err, "Storing "+key+" cold failed, caching it")
+	}
+	if pinned {
+		r.Set("shadow::"+key, "", 0)
+		r.Set(key, zipped, 0)
+		return nil
+	}
+	expire := CachingTime()
+	r.Set("shadow::"+key, "", expire)
+	r.Set(key, zipped, 0)
+	enqueueOffload(r, key, time.Now().Add(expire))
+	return nil
+}
+
+// decodeValue reverses the encoding of cacheValue.
+func decodeValue(raw string) (map[string]string, error) {
+	var dat map[string]string
+	unzipped, err := helper.Unzip(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(unzipped), &dat); err != nil {
+		return nil, err
+	}
+	return dat, nil
+}
+
+// execPipeline runs queued commands. Missing keys aren't an error,
+// they are reported by the single commands.
+func execPipeline(r *redis.Pipeline) error {
+	if _, err := r.Exec(); err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
+
+// loadValue decodes a value fetched from redis or cold storage.
+func loadValue(key string, value *redis.StringCmd) (map[string]string, error) {
+	blob, err := loadBlob(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(blob)
+}
+
+// loadBlob returns a blob fetched from redis. Blobs which are missing
+// in redis are loaded from cold storage and cached again, unless they
+// exceed HOT_MAX_BYTES. The cold copy is only removed once it is cached.
+func loadBlob(key string, value *redis.StringCmd) (string, error) {
+	blob, err := value.Result()
+	if err == nil {
+		if err := touch(key); err != nil {
+			log.Warn(err, "Recording read of "+key+" failed")
+		}
+		return blob, nil
+	}
+	if err != redis.Nil {
+		return "", err
+	}
+	blob, err = helper.ColdGet(key)
+	if err == helper.ErrNotFound {
+		countTier("misses")
+	}
+	if err != nil {
+		return "", err
+	}
+	countTier("cold_hits")
+	pinned, err := isPinned(key)
+	if err != nil {
+		log.Warn(err, "Reading pin of "+key+" failed, serving it cold")
+		return blob, nil
+	}
+	if !hot(len(blob), pinned) {
+		return blob, nil
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	if err := cacheBlob(pipe, key, blob, pinned); err != nil {
+		return "", err
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return "", err
+	}
+	countTier("promotions")
+	if err := helper.ColdDel(key); err != nil {
+		log.Warn(err, "Removing cold copy of "+key+" failed")
+	}
+	return blob, nil
+}
+
+// deleteValue removes a value from redis and cold storage.
+func deleteValue(key string) error {
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	pipe.Del(key, "shadow::"+key)
+	pipe.ZRem(OffloadQueue, key)
+	pipe.ZRem(OffloadClaims, key)
+	pipe.SRem(pinnedKeys, key)
+	pipe.HDel(pinCounts, key)
+	pipe.Del("tier::hits::" + key)
+	if err := execPipeline(pipe); err != nil {
+		return err
+	}
+	if err := helper.ColdDel(key); err != nil && err != helper.ErrColdUnavailable {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package models
+
+import (
+	"github.com/muhproductions/muh/helper"
+	"gopkg.in/redis.v3"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// tierStats - Hash of read and move counters per tier
+	tierStats = "tier::stats"
+	// pinnedKeys - Set of cached keys, which are never offloaded
+	pinnedKeys = "tier::pinned"
+	// pinCounts - Hash of the pinned gists per key, bodies are shared
+	pinCounts = "tier::pins"
+)
+
+// pinKeys pins the keys of a gist, unless it's pinned already.
+var pinKeys = redis.NewScript(`
+if redis.call('SETNX', KEYS[1], '') == 0 then
+	return 0
+end
+for i = 1, #ARGV do
+	redis.call('HINCRBY', KEYS[3], ARGV[i], 1)
+	redis.call('SADD', KEYS[2], ARGV[i])
+end
+return 1
+`)
+
+// unpinKeys drops a pin of the keys. With ARGV[1] set to gist, only
+// if the gist is still pinned. It returns the keys, which are not
+// pinned by any gist anymore.
+var unpinKeys = redis.NewScript(`
+local released = {}
+if ARGV[1] == 'gist' and redis.call('DEL', KEYS[1]) == 0 then
+	return released
+end
+for i = 2, #ARGV do
+	if redis.call('HINCRBY', KEYS[3], ARGV[i], -1) <= 0 then
+		redis.call('HDEL', KEYS[3], ARGV[i])
+		redis.call('SREM', KEYS[2], ARGV[i])
+		table.insert(released, ARGV[i])
+	end
+end
+return released
+`)
+
+// touchValue counts a read served by redis. lru extends the cache of
+// the value, lfu counts its reads.
+var touchValue = redis.NewScript(`
+redis.call('HINCRBY', KEYS[4], 'hot_hits', 1)
+local expire = tonumber(ARGV[3])
+if expire <= 0 then
+	return 0
+end
+if ARGV[2] == 'lru' and redis.call('PTTL', KEYS[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], expire)
+	redis.call('ZADD', KEYS[2], tonumber(ARGV[4]) + math.floor(expire / 1000), ARGV[1])
+elseif ARGV[2] == 'lfu' then
+	redis.call('INCR', KEYS[3])
+	redis.call('PEXPIRE', KEYS[3], 2 * expire)
+end
+return 0
+`)
+
+// retainFrequent caches a value once more, if it was read often enough
+// since it was cached. The read counter starts over.
+var retainFrequent = redis.NewScript(`
+local hits = tonumber(redis.call('GET', KEYS[1]) or '0')
+redis.call('DEL', KEYS[1])
+if hits < tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SET', KEYS[2], '', 'PX', ARGV[3])
+redis.call('ZADD', KEYS[3], tonumber(ARGV[4]) + math.floor(tonumber(ARGV[3]) / 1000), ARGV[1])
+return 1
+`)
+
+// CachingTime returns how long values stay in redis, set by
+// CACHING_TIME. Defaults to one hour.
+func CachingTime() time.Duration {
+	expire, err := time.ParseDuration(os.Getenv("CACHING_TIME"))
+	if err != nil {
+		return time.Hour
+	}
+	return expire
+}
+
+// TieringPolicy returns when values are moved into cold storage, set
+// by TIERING_POLICY:
+//  * fixed - CACHING_TIME after they were cached (default)
+//  * lru - CACHING_TIME after they were read the last time
+//  * lfu - once they were read less than TIERING_LFU_HITS times
+//    within CACHING_TIME
+func TieringPolicy() string {
+	switch policy := os.Getenv("TIERING_POLICY"); policy {
+	case "lru", "lfu":
+		return policy
+	}
+	return "fixed"
+}
+
+// lfuHits returns the reads which keep a value in redis with lfu,
+// set by TIERING_LFU_HITS. Defaults to 2.
+func lfuHits() int64 {
+	hits, err := strconv.ParseInt(os.Getenv("TIERING_LFU_HITS"), 10, 64)
+	if err != nil || hits <= 0 {
+		return 2
+	}
+	return hits
+}
+
+// HotMaxBytes returns the size of the largest encoded value kept in
+// redis, set by HOT_MAX_BYTES. Larger values are stored and served
+// cold, unless pinned. 0 means unlimited.
+func HotMaxBytes() int {
+	max, _ := strconv.Atoi(os.Getenv("HOT_MAX_BYTES"))
+	return max
+}
+
+// isPinned reports whether the key belongs to a pinned gist.
+func isPinned(key string) (bool, error) {
+	return helper.RedisClient().SIsMember(pinnedKeys, key).Result()
+}
+
+// pinKey pins a key added to a pinned gist.
+func pinKey(r *redis.Pipeline, key string) {
+	r.HIncrBy(pinCounts, key, 1)
+	r.SAdd(pinnedKeys, key)
+}
+
+// hot reports whether a value of the given size belongs into redis.
+func hot(size int, pinned bool) bool {
+	max := HotMaxBytes()
+	return pinned || max <= 0 || size <= max
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// countTier increments a counter of TierStats.
+func countTier(counter string) {
+	helper.RedisClient().HIncrBy(tierStats, counter, 1)
+}
+
+// touch records a read served by redis.
+func touch(key string) error {
+	return touchValue.Run(helper.RedisClient(), []string{
+		"shadow::" + key,
+		OffloadQueue,
+		"tier::hits::" + key,
+		tierStats,
+	}, []string{
+		key,
+		TieringPolicy(),
+		milliseconds(CachingTime()),
+		unix(time.Now()),
+	}).Err()
+}
+
+// retain reports whether lfu keeps the value in redis for another
+// CACHING_TIME instead of offloading it.
+func retain(key string) (bool, error) {
+	expire := CachingTime()
+	if TieringPolicy() != "lfu" || expire <= 0 {
+		return false, nil
+	}
+	retained, err := retainFrequent.Run(helper.RedisClient(), []string{
+		"tier::hits::" + key,
+		"shadow::" + key,
+		OffloadQueue,
+	}, []string{
+		key,
+		strconv.FormatInt(lfuHits(), 10),
+		milliseconds(expire),
+		unix(time.Now()),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	return retained == int64(1), nil
+}
+
+// TierStats returns the tiering policy, the reads served by redis
+// (hot_hits) and cold storage (cold_hits), reads of missing values,
+// the values moved between them and the ratio of reads served by redis.
+func TierStats() (map[string]interface{}, error) {
+	counters, err := helper.RedisClient().HGetAllMap(tierStats).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]interface{}{
+		"policy": TieringPolicy(),
+	}
+	values := map[string]int64{}
+	for _, counter := range []string{"hot_hits", "cold_hits", "misses", "promotions", "demotions"} {
+		values[counter], _ = strconv.ParseInt(counters[counter], 10, 64)
+		stats[counter] = values[counter]
+	}
+	reads := values["hot_hits"] + values["cold_hits"] + values["misses"]
+	stats["hot_ratio"] = 0.0
+	if reads > 0 {
+		stats["hot_ratio"] = float64(values["hot_hits"]) / float64(reads)
+	}
+	return stats, nil
+}
+
+func (g *Gist) keyPinned() string {
+	return "gists::" + g.UUID + "::pinned"
+}
+
+// Pinned reports whether the snippets of the gist are kept in redis.
+func (g *Gist) Pinned() (bool, error) {
+	return helper.RedisClient().Exists(g.keyPinned()).Result()
+}
+
+// snippetKeys returns the keys of the snippets and bodies of the gist.
+func (g *Gist) snippetKeys() ([]string, error) {
+	var keys []string
+	snippets, err := g.snippetValues()
+	if err != nil {
+		return nil, err
+	}
+	for id, value := range snippets {
+		keys = append(keys, "snippets::"+id)
+		if id := snippetBody(value); id != "" {
+			keys = append(keys, bodyKey(id))
+		}
+	}
+	return keys, nil
+}
+
+// Pin keeps the snippets of the gist in redis, regardless of the
+// tiering policy. Cold snippets are loaded back.
+func (g *Gist) Pin() error {
+	keys, err := g.snippetKeys()
+	if err != nil {
+		return err
+	}
+	err = pinKeys.Run(helper.RedisClient(), []string{g.keyPinned(), pinnedKeys, pinCounts}, keys).Err()
+	if err != nil {
+		return err
+	}
+	if _, err := g.GetSnippets(); err != nil {
+		return err
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	for _, key := range keys {
+		pipe.Persist("shadow::" + key)
+		pipe.ZRem(OffloadQueue, key)
+	}
+	return execPipeline(pipe)
+}
+
+// Unpin hands the snippets of the gist back to the tiering policy.
+// Bodies shared with another pinned gist stay pinned.
+func (g *Gist) Unpin() error {
+	keys, err := g.snippetKeys()
+	if err != nil {
+		return err
+	}
+	return g.unpin("gist", keys)
+}
+
+// unpin drops the pins of the keys and hands the keys, which are not
+// pinned anymore, back to the tiering policy.
+func (g *Gist) unpin(scope string, keys []string) error {
+	released, err := unpinKeys.Run(helper.RedisClient(), []string{g.keyPinned(), pinnedKeys, pinCounts},
+		append([]string{scope}, keys...)).Result()
+	if err != nil {
+		return err
+	}
+	expire := CachingTime()
+	if expire <= 0 {
+		return nil
+	}
+	pipe := helper.RedisClient().Pipeline()
+	defer pipe.Close()
+	for _, key := range released.([]interface{}) {
+		pipe.PExpire("shadow::"+key.(string), expire)
+		enqueueOffload(pipe, key.(string), time.Now().Add(expire))
+	}
+	return execPipeline(pipe)
+}
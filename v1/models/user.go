@@ -20,10 +20,14 @@ import (
 	"github.com/muhproductions/muh/helper"
 	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/redis.v3"
 	"reflect"
-	"string"
+	"strings"
 )
 
+// ErrUserNotFound is returned for users which don't exist.
+var ErrUserNotFound = errors.New("user not existing")
+
 // User model
 type User struct {
 	UUID           string
@@ -54,47 +58,59 @@ func FindUserByUUID(uuid string) (User, error) {
 }
 
 func findAtomicUser(user User) (User, error) {
-	if user.Available() {
-		return user, nil
+	available, err := user.Available()
+	if err != nil {
+		return user, err
+	}
+	if !available {
+		return user, ErrUserNotFound
 	}
-	return user, errors.New("user not existing")
+	return user, nil
 }
 
 //EqualsPassword verifies password
-func (u *User) EqualsPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword(
-		[]byte(u.GetPasswordDigest()),
+func (u *User) EqualsPassword(password string) (bool, error) {
+	digest, err := u.GetPasswordDigest()
+	if err != nil {
+		return false, err
+	}
+	err = bcrypt.CompareHashAndPassword(
+		[]byte(digest),
 		[]byte(password),
 	)
-	return (err == nil)
+	return err == nil, nil
 }
 
-func fetchIdsByKey(key string) []string {
+func fetchIdsByKey(key string) ([]string, error) {
+	keys, err := helper.RedisClient().Keys(key + "::*").Result()
+	if err != nil {
+		return nil, err
+	}
 	var ids []string
-	for _, v := range helper.RedisClient().Keys(key + "::*").Val() {
+	for _, v := range keys {
 		ids = append(ids, strings.Replace(v, key, "", -1))
 	}
-	return ids
+	return ids, nil
 }
 
 // CreatedGists returns a list with gist id's
-func (u *User) CreatedGists() []string {
-	return fetchIdsByKey("users::" + u.GetUUID() + "::gists")
+func (u *User) CreatedGists() ([]string, error) {
+	return fetchIdsByKey("users::" + u.UUID + "::gists")
 }
 
 // MarkGist marks a new gist
 func (u *User) MarkGist(UUID string) bool {
 	gist := Gist{UUID: UUID}
-	if gist.Exists() {
-		helper.RedisClient().SAdd("users::" + u.GetUUID() + "::marked_gists")
+	if exists, err := gist.Exists(); err == nil && exists {
+		helper.RedisClient().SAdd("users::" + u.UUID + "::marked_gists")
 		return true
 	}
 	return false
 }
 
 // MarkedGists returns a list of marked gists.
-func (u *User) MarkedGists() []string {
-	return fetchIdsByKey("users::" + u.GetUUID() + "::marked_gists")
+func (u *User) MarkedGists() ([]string, error) {
+	return fetchIdsByKey("users::" + u.UUID + "::marked_gists")
 }
 
 //SetPassword calculates a bcrypt hash and updates objects PasswordDigest.
@@ -104,30 +120,27 @@ func (u *User) SetPassword(password string) {
 }
 
 //Available check if user is available.
-func (u *User) Available() bool {
+func (u *User) Available() (bool, error) {
 	if u.Username != "" {
-		return helper.RedisClient().Exists(u.keyName()).Val()
+		return helper.RedisClient().Exists(u.keyName()).Result()
 	} else if u.UUID != "" {
-		return helper.RedisClient().Exists(u.keyID()).Val()
+		return helper.RedisClient().Exists(u.keyID()).Result()
 	}
-	return false
+	return false, nil
 }
 
 // Save user by using current redis session to database.
-func (u *User) Save() bool {
+func (u *User) Save() error {
 	pipe := helper.RedisClient().Pipeline()
 	defer pipe.Close()
 	pipe.Set(u.keyID(), u.EncodedUsername(), 0)
-	pipe.Set(u.keyName(), u.GetUUID(), 0)
-	pipe.Set(u.keyPass(), u.GetPasswordDigest(), 0)
+	pipe.Set(u.keyName(), u.UUID, 0)
+	pipe.Set(u.keyPass(), u.PasswordDigest, 0)
 	_, err := pipe.Exec()
-	return (err == nil)
+	return err
 }
 
 func (u *User) keyID() string {
-	if u.UUID == "" {
-		return "user::id::" + u.GetUUID()
-	}
 	return "user::id::" + u.UUID
 }
 
@@ -140,47 +153,52 @@ func (u *User) keyPass() string {
 }
 
 // EncodedUsername encodes the username into base64 to prevent
-// to handle each kind of username.
+// to handle each kind of username. Users found by UUID need their
+// username loaded by GetUsername first.
 func (u *User) EncodedUsername() string {
-	username := u.Username
-	if username == "" {
-		username = u.GetUsername()
-	}
-	return base64.StdEncoding.EncodeToString([]byte(username))
+	return base64.StdEncoding.EncodeToString([]byte(u.Username))
 }
 
-func (u *User) cachedResponse(prop string, key string) string {
+// cachedResponse returns a property, it's fetched from redis unless set.
+// Missing keys leave it empty.
+func (u *User) cachedResponse(prop string, key string) (string, error) {
 	v := reflect.ValueOf(u).Elem().FieldByName(prop)
 	if v.String() == "" {
-		v.SetString(helper.RedisClient().Get(key).Val())
+		value, err := helper.RedisClient().Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+		v.SetString(value)
 	}
-	return v.String()
+	return v.String(), nil
 }
 
 // GetUUID returns the objects internal UUID or prefetch them from datastore
-func (u *User) GetUUID() string {
+func (u *User) GetUUID() (string, error) {
 	return u.cachedResponse("UUID", u.keyName())
 }
 
 // ResetUUID sets a new UUID to current user.
-func (u *User) ResetUUID() string {
+func (u *User) ResetUUID() (string, error) {
 	id := uuid.NewV4().String()
 	pipe := helper.RedisClient().Pipeline()
 	defer pipe.Close()
 	pipe.Set(u.keyID(), u.EncodedUsername(), 0)
 	pipe.Set(u.keyName(), id, 0)
 	pipe.Del(u.keyID())
-	pipe.Exec()
+	if _, err := pipe.Exec(); err != nil {
+		return "", err
+	}
 	u.UUID = id
-	return id
+	return id, nil
 }
 
 // GetUsername returns the objects internal username or prefetch them from datastore
-func (u *User) GetUsername() string {
+func (u *User) GetUsername() (string, error) {
 	return u.cachedResponse("Username", u.keyID())
 }
 
 // GetPasswordDigest returns the objects internal passwordDigest or prefetch them from datastore
-func (u *User) GetPasswordDigest() string {
+func (u *User) GetPasswordDigest() (string, error) {
 	return u.cachedResponse("PasswordDigest", u.keyPass())
 }
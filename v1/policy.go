@@ -0,0 +1,215 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/muhproductions/muh/helper"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budget - Limits within a period, 0 means unlimited.
+type Budget struct {
+	Hits  int64 `json:"hits"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Policy - Ratelimit for requests matching one of the methods and
+// paths. Empty lists match everything. Paths are globs, where "*"
+// matches within a path segment and "**" across segments.
+// Authenticated users and api keys may get a different budget.
+type Policy struct {
+	Name    string   `json:"name"`
+	Methods []string `json:"methods"`
+	Paths   []string `json:"paths"`
+	Period  string   `json:"period"`
+	Budget
+	Authenticated *Budget `json:"authenticated"`
+	APIKey        *Budget `json:"api_key"`
+
+	period time.Duration
+	paths  []*regexp.Regexp
+}
+
+// RatelimitConfig - Ratelimit policies, the first matching policy
+// applies. Requests to exempt routes ("GET /v1/ping" or a path glob),
+// from allowed networks or not matching any policy are not limited.
+// APIKeys maps keys passed by "X-Api-Key" to names.
+type RatelimitConfig struct {
+	Exempt   []string          `json:"exempt"`
+	Allow    []string          `json:"allow"`
+	APIKeys  map[string]string `json:"api_keys"`
+	Policies []Policy          `json:"policies"`
+
+	exempt []route
+	allow  []*net.IPNet
+}
+
+type route struct {
+	method string
+	path   *regexp.Regexp
+}
+
+func (r route) matches(method, path string) bool {
+	return (r.method == "" || r.method == method) && r.path.MatchString(path)
+}
+
+// glob compiles a path glob into a regular expression.
+func glob(pattern string) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*\*`, `.*`, -1)
+	expr = strings.Replace(expr, `\*`, `[^/]*`, -1)
+	return regexp.Compile("^" + expr + "$")
+}
+
+func parseRoute(value string) (route, error) {
+	fields := strings.Fields(value)
+	r := route{}
+	switch len(fields) {
+	case 1:
+	case 2:
+		r.method = strings.ToUpper(fields[0])
+	default:
+		return r, errors.New("invalid route: " + value)
+	}
+	path, err := glob(fields[len(fields)-1])
+	r.path = path
+	return r, err
+}
+
+// matches checks whether the policy applies to a request.
+func (p *Policy) matches(method, path string) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, m := range p.Methods {
+			found = found || strings.ToUpper(m) == method
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.paths) == 0 {
+		return true
+	}
+	for _, expr := range p.paths {
+		if expr.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RatelimitConfig) compile() error {
+	for _, value := range c.Exempt {
+		r, err := parseRoute(value)
+		if err != nil {
+			return err
+		}
+		c.exempt = append(c.exempt, r)
+	}
+	allow, err := helper.ParseNetworks(c.Allow)
+	if err != nil {
+		return err
+	}
+	c.allow = allow
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		p.period = ratelimitPeriod()
+		if p.Period != "" {
+			period, err := time.ParseDuration(p.Period)
+			if err != nil || period <= 0 {
+				return errors.New("invalid period of policy " + p.Name)
+			}
+			p.period = period
+		}
+		for _, pattern := range p.Paths {
+			expr, err := glob(pattern)
+			if err != nil {
+				return err
+			}
+			p.paths = append(p.paths, expr)
+		}
+	}
+	return nil
+}
+
+// exempted checks whether a request bypasses ratelimiting.
+func (c *RatelimitConfig) exempted(method, path, ip string) bool {
+	for _, r := range c.exempt {
+		if r.matches(method, path) {
+			return true
+		}
+	}
+	return helper.InNetworks(c.allow, ip)
+}
+
+// policy returns the first policy matching the request.
+func (c *RatelimitConfig) policy(method, path string) *Policy {
+	for i := range c.Policies {
+		if c.Policies[i].matches(method, path) {
+			return &c.Policies[i]
+		}
+	}
+	return nil
+}
+
+// LoadRatelimitConfig reads ratelimit policies from a json file.
+func LoadRatelimitConfig(path string) (*RatelimitConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RatelimitConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, config.compile()
+}
+
+// envRatelimitConfig builds a single policy from LIMIT_HITS and
+// LIMIT_BYTES, which is used without RATELIMIT_CONFIG.
+func envRatelimitConfig() *RatelimitConfig {
+	hits, _ := strconv.ParseInt(os.Getenv("LIMIT_HITS"), 10, 64)
+	bytes, _ := strconv.ParseInt(os.Getenv("LIMIT_BYTES"), 10, 64)
+	config := &RatelimitConfig{
+		Exempt: []string{"GET /v1/ping", "GET /v1/health"},
+		Policies: []Policy{
+			{Budget: Budget{Hits: hits, Bytes: bytes}},
+		},
+	}
+	config.compile()
+	return config
+}
+
+// ratelimitConfig returns the policies of RATELIMIT_CONFIG
+// or falls back to the environment.
+func ratelimitConfig() *RatelimitConfig {
+	path := os.Getenv("RATELIMIT_CONFIG")
+	if path == "" {
+		return envRatelimitConfig()
+	}
+	config, err := LoadRatelimitConfig(path)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
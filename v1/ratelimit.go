@@ -15,50 +15,194 @@
 package v1
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
-	"github.com/muhproductions/muh/helper"
-	"os"
+	"github.com/muhproductions/muh/v1/models"
+	"github.com/muhproductions/muh/v1/resources"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Ratelimit - Middleware to handle ratelimiting.
-// - Rejecting reqests...
-// - Bumping request/ip count ...
+// Ratelimit - Middleware to handle ratelimiting by the policies
+// of RATELIMIT_CONFIG, or LIMIT_HITS and LIMIT_BYTES otherwise.
 func Ratelimit() gin.HandlerFunc {
+	return RatelimitWith(ratelimitConfig())
+}
+
+// RatelimitWith - Middleware to handle ratelimiting.
+// - Counting requests and transferred bytes per client in a sliding
+//   window of the matching policy.
+// - Rejecting requests exceeding the budget of the policy.
+func RatelimitWith(config *RatelimitConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		t := time.Now()
+		method, path := c.Request.Method, c.Request.URL.Path
+		if config.exempted(method, path, c.ClientIP()) {
+			c.Next()
+			return
+		}
+		policy := config.policy(method, path)
+		if policy == nil {
+			c.Next()
+			return
+		}
+		subject, budget := ratelimitSubject(config, policy, c)
 
-		pipe := helper.RedisClient().Pipeline()
-		hits := pipe.Incr("ratelimit::hits::" + c.ClientIP())
-		bytes := pipe.IncrBy("ratelimit::bytes::"+c.ClientIP(), c.Request.ContentLength)
-		defer pipe.Close()
-		pipe.Exec()
-
-		ratelimitcheck("Hits", hits.Val(), c)
-		ratelimitcheck("Bytes", bytes.Val(), c)
+		prefix := "ratelimit::"
+		if policy.Name != "" {
+			prefix += policy.Name + "::"
+		}
+		hits, err := ratelimiter().Hit(prefix+"hits::"+subject, 1, policy.period)
+		if err != nil {
+			log.Error(err, "Ratelimit failed")
+		}
+		// bytes are known after the request, only check the budget
+		bytes, err := ratelimiter().Hit(prefix+"bytes::"+subject, 0, policy.period)
+		if err != nil {
+			log.Error(err, "Ratelimit failed")
+		}
 
 		c.Header("X-Ratelimit-Latency", time.Since(t).String())
 
+		if !ratelimitcheck(c, policy, []usage{
+			{"Hits", hits, budget.Hits},
+			{"Bytes", bytes, budget.Bytes},
+		}) {
+			return
+		}
+		body := &countingReader{ReadCloser: c.Request.Body}
+		if c.Request.Body != nil {
+			c.Request.Body = body
+		}
 		c.Next()
+		if _, err := ratelimiter().Hit(prefix+"bytes::"+subject, transferred(c, body), policy.period); err != nil {
+			log.Error(err, "Ratelimit failed")
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// transferred returns the bytes uploaded and downloaded by a request.
+// The announced body size counts even if it wasn't read by the handler.
+func transferred(c *gin.Context, body *countingReader) int64 {
+	uploaded := body.count
+	if c.Request.ContentLength > uploaded {
+		uploaded = c.Request.ContentLength
+	}
+	downloaded := int64(c.Writer.Size())
+	if downloaded < 0 {
+		downloaded = 0
 	}
+	return uploaded + downloaded
 }
 
-func ratelimitcheck(name string, value int64, c *gin.Context) {
-	converted := strconv.Itoa(int(value))
-	c.Header("X-Ratelimit-"+name, converted)
-	env := os.Getenv("LIMIT_" + strings.ToUpper(name))
-	if env != "" {
-		c.Header("X-Ratelimit-"+name+"-Limit", env)
-		limit, _ := strconv.Atoi(env)
-		if value > int64(limit) {
-			c.Header("X-Ratelimit-"+name+"-State", "BLOCKED")
-			c.AbortWithStatus(429)
+// ratelimitSubject returns whom the request is accounted to and
+// its budget: an api key, an authenticated user or the client ip.
+func ratelimitSubject(config *RatelimitConfig, policy *Policy, c *gin.Context) (string, Budget) {
+	if name, found := config.APIKeys[c.Request.Header.Get("X-Api-Key")]; found {
+		if policy.APIKey != nil {
+			return "key::" + name, *policy.APIKey
+		}
+		return "key::" + name, policy.Budget
+	}
+	if policy.Authenticated != nil {
+		token := resources.AuthToken(c)
+		if token == "" {
+			token = c.Param("userid")
+		}
+		if token != "" {
+			if _, err := models.FindUserByUUID(token); err == nil {
+				return "user::" + token, *policy.Authenticated
+			}
+		}
+	}
+	return c.ClientIP(), policy.Budget
+}
+
+// usage - Counted window of a budget, a limit of 0 means unlimited.
+type usage struct {
+	name   string
+	window Window
+	limit  int64
+}
+
+func (u usage) remaining() int64 {
+	if remaining := u.limit - u.window.Count(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (u usage) exceeded() bool {
+	return u.limit > 0 && u.window.Count() > u.limit
+}
+
+// ratelimitcheck sets the ratelimit headers of all budgets and
+// rejects the request once a limit is exceeded. Besides the legacy
+// X-Ratelimit-<Budget>-* headers, the RateLimit-* headers of the IETF
+// draft describe the budget closest to its limit.
+func ratelimitcheck(c *gin.Context, policy *Policy, usages []usage) bool {
+	var closest, blocked *usage
+	policies := []string{}
+	for i := range usages {
+		u := &usages[i]
+		c.Header("X-Ratelimit-"+u.name, strconv.FormatInt(u.window.Count(), 10))
+		if u.limit <= 0 {
+			continue
+		}
+		c.Header("X-Ratelimit-"+u.name+"-Limit", strconv.FormatInt(u.limit, 10))
+		c.Header("X-Ratelimit-"+u.name+"-Reset", seconds(u.window.Reset()))
+		policies = append(policies, strconv.FormatInt(u.limit, 10)+";w="+seconds(policy.period))
+		if closest == nil || u.remaining()*closest.limit < closest.remaining()*u.limit {
+			closest = u
+		}
+		if u.exceeded() {
+			c.Header("X-Ratelimit-"+u.name+"-State", "BLOCKED")
+			if blocked == nil || u.window.RetryAfter(u.limit) > blocked.window.RetryAfter(blocked.limit) {
+				blocked = u
+			}
 		} else {
-			c.Header("X-Ratelimit-"+name+"-State", "OK")
+			c.Header("X-Ratelimit-"+u.name+"-State", "OK")
 		}
 	}
+	if closest != nil {
+		c.Header("RateLimit-Limit", strconv.FormatInt(closest.limit, 10))
+		c.Header("RateLimit-Remaining", strconv.FormatInt(closest.remaining(), 10))
+		c.Header("RateLimit-Reset", seconds(closest.window.Reset()))
+		c.Header("RateLimit-Policy", strings.Join(policies, ", "))
+	}
+	if blocked == nil {
+		return true
+	}
+	retry := blocked.window.RetryAfter(blocked.limit)
+	c.Header("Retry-After", seconds(retry))
+	resources.Abort(c, 429, "ratelimited", "Ratelimit of "+strings.ToLower(blocked.name)+" exceeded", gin.H{
+		"budget":      strings.ToLower(blocked.name),
+		"policy":      policy.Name,
+		"limit":       blocked.limit,
+		"count":       blocked.window.Count(),
+		"reset":       int64(math.Ceil(blocked.window.Reset().Seconds())),
+		"retry_after": int64(math.Ceil(retry.Seconds())),
+	})
+	return false
+}
 
+// seconds formats a duration as whole seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
 }
@@ -0,0 +1,54 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/helper"
+	"net"
+	"os"
+	"strings"
+)
+
+// RealIP - Middleware to determine the client address for ratelimiting
+// and logging. Forwarding headers are only trusted from the proxies
+// listed in TRUSTED_PROXIES (comma separated CIDRs).
+func RealIP() gin.HandlerFunc {
+	trusted, err := helper.ParseNetworks(strings.Split(os.Getenv("TRUSTED_PROXIES"), ","))
+	if err != nil {
+		panic(err)
+	}
+	return RealIPWith(trusted)
+}
+
+// RealIPWith - Middleware rewriting the remote address of a request to
+// the client address. Forwarding headers are removed afterwards, so
+// c.ClientIP() can't be spoofed.
+func RealIPWith(trusted []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := helper.ClientIP(c.Request, trusted)
+		_, port, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			port = "0"
+		}
+		if ip != "" {
+			c.Request.RemoteAddr = net.JoinHostPort(ip, port)
+		}
+		c.Request.Header.Del("Forwarded")
+		c.Request.Header.Del("X-Forwarded-For")
+		c.Request.Header.Del("X-Real-Ip")
+		c.Next()
+	}
+}
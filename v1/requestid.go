@@ -0,0 +1,39 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/v1/resources"
+	"github.com/satori/go.uuid"
+	"regexp"
+)
+
+var requestIDFormat = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID - Middleware to tag each request with an id, which is
+// returned as X-Request-Id and within error responses. A valid id
+// passed by the client is kept.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get("X-Request-Id")
+		if !requestIDFormat.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		c.Set(resources.RequestIDKey, id)
+		c.Header("X-Request-Id", id)
+		c.Next()
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/v1/models"
+	"strings"
+)
+
+// AuthToken returns the user uuid passed by the
+// "Authorization: Token <uuid>" header.
+func AuthToken(c *gin.Context) string {
+	header := c.Request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Token ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Token "))
+}
+
+// currentUser returns the authenticated user of the request. It
+// responds with 401 for unknown users and 500 on errors.
+func currentUser(c *gin.Context) (models.User, bool) {
+	token := AuthToken(c)
+	if token == "" {
+		Unauthorized(c)
+		return models.User{}, false
+	}
+	user, err := models.FindUserByUUID(token)
+	if err == models.ErrUserNotFound {
+		Unauthorized(c)
+		return user, false
+	}
+	if err != nil {
+		InternalError(c, err)
+		return user, false
+	}
+	return user, true
+}
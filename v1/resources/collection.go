@@ -0,0 +1,319 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/v1/models"
+	"strings"
+)
+
+// CollectionResource - Tags and collections of users
+type CollectionResource struct {
+	Engine *gin.RouterGroup
+}
+
+type rawTags struct {
+	Tags []string `json:"tags" form:"tags" binding:"required"`
+}
+
+type rawCollection struct {
+	Name string `json:"name" form:"name" binding:"required"`
+}
+
+// Routes - Setup tag and collection routes
+func (r CollectionResource) Routes() {
+	r.Engine.GET("/users/:userid/tags", r.Tags)
+	r.Engine.GET("/users/:userid/tags/:tag", r.TaggedGists)
+	r.Engine.GET("/users/:userid/gists/:uuid/tags", r.GistTags)
+	r.Engine.PUT("/users/:userid/gists/:uuid/tags", r.TagGist)
+	r.Engine.DELETE("/users/:userid/gists/:uuid/tags/:tag", r.UntagGist)
+
+	r.Engine.GET("/users/:userid/collections", r.List)
+	r.Engine.PUT("/users/:userid/collections", r.Create)
+	r.Engine.GET("/users/:userid/collections/:collection", r.Get)
+	r.Engine.DELETE("/users/:userid/collections/:collection", r.Delete)
+	r.Engine.PUT("/users/:userid/collections/:collection/gists/:uuid", r.AddGist)
+	r.Engine.DELETE("/users/:userid/collections/:collection/gists/:uuid", r.RemoveGist)
+}
+
+func userGist(c *gin.Context) (models.User, models.Gist, bool) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return user, models.Gist{}, false
+	}
+	gist, ok := existingGist(c)
+	return user, gist, ok
+}
+
+func userCollection(c *gin.Context) (models.User, string, bool) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return user, "", false
+	}
+	name, found, err := user.CollectionName(c.Param("collection"))
+	if err != nil {
+		InternalError(c, err)
+		return user, name, false
+	}
+	if !found {
+		NotFound("Collection", c)
+		return user, name, false
+	}
+	return user, name, true
+}
+
+func respondTags(c *gin.Context, user models.User, gist models.Gist) {
+	info, ok := gistInfo(c, gist)
+	if !ok {
+		return
+	}
+	tags, err := user.GistTags(gist.UUID)
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"gist": info,
+		"tags": tags,
+	})
+}
+
+// Tags - All tags used by the user
+func (r CollectionResource) Tags(c *gin.Context) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	tags, err := user.Tags()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"tags": tags,
+	})
+}
+
+// TaggedGists - Gists tagged with a tag
+func (r CollectionResource) TaggedGists(c *gin.Context) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	gists, err := user.TaggedGists(strings.ToLower(c.Param("tag")))
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"tag":   c.Param("tag"),
+		"gists": gists,
+	})
+}
+
+// GistTags - Tags of a gist
+func (r CollectionResource) GistTags(c *gin.Context) {
+	user, gist, ok := userGist(c)
+	if ok {
+		respondTags(c, user, gist)
+	}
+}
+
+/*
+TagGist - Add tags to a gist
+
+	# curl -X PUT $API/users/<userid>/gists/<uuid>/tags \
+		-H 'Content-Type: application/json' -d '{"tags": ["nginx", "prod"]}'
+	{
+		"gist": { "uuid": <UUID> },
+		"tags": ["nginx", "prod"]
+	}
+*/
+func (r CollectionResource) TagGist(c *gin.Context) {
+	user, gist, ok := userGist(c)
+	if !ok {
+		return
+	}
+	var raw rawTags
+	if !bind(c, &raw) {
+		return
+	}
+	tags := []string{}
+	for _, tag := range raw.Tags {
+		normalized, err := models.NormalizeTag(tag)
+		if err != nil {
+			Unprocessable(c, err.Error(), gin.H{"tag": tag})
+			return
+		}
+		tags = append(tags, normalized)
+	}
+	if err := user.TagGist(gist.UUID, tags); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondTags(c, user, gist)
+}
+
+// UntagGist - Remove a tag from a gist
+func (r CollectionResource) UntagGist(c *gin.Context) {
+	user, gist, ok := userGist(c)
+	if !ok {
+		return
+	}
+	if err := user.UntagGist(gist.UUID, strings.ToLower(c.Param("tag"))); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondTags(c, user, gist)
+}
+
+// List - Collections of the user
+func (r CollectionResource) List(c *gin.Context) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	names, err := user.Collections()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	collections := []map[string]string{}
+	for id, name := range names {
+		collections = append(collections, map[string]string{
+			"uuid": id,
+			"name": name,
+		})
+	}
+	c.JSON(200, gin.H{
+		"collections": collections,
+	})
+}
+
+/*
+Create - Create a new collection
+
+	# curl -X PUT $API/users/<userid>/collections -d 'name=configs'
+	{
+		"collection": {
+			"uuid": <UUID>,
+			"name": "configs"
+		},
+		"gists": []
+	}
+*/
+func (r CollectionResource) Create(c *gin.Context) {
+	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	var raw rawCollection
+	if !bind(c, &raw) {
+		return
+	}
+	name := strings.TrimSpace(raw.Name)
+	if name == "" || len(name) > 100 {
+		Unprocessable(c, "Collection name must have 1-100 characters", nil)
+		return
+	}
+	id, err := user.CreateCollection(name)
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(201, gin.H{
+		"collection": map[string]string{
+			"uuid": id,
+			"name": name,
+		},
+		"gists": []string{},
+	})
+}
+
+func respondCollection(c *gin.Context, id string, name string) {
+	gists, err := models.CollectionGists(id)
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"collection": map[string]string{
+			"uuid": id,
+			"name": name,
+		},
+		"gists": gists,
+	})
+}
+
+// Get - A collection and its gists
+func (r CollectionResource) Get(c *gin.Context) {
+	_, name, ok := userCollection(c)
+	if ok {
+		respondCollection(c, c.Param("collection"), name)
+	}
+}
+
+// Delete - Remove a collection, the gists are kept
+func (r CollectionResource) Delete(c *gin.Context) {
+	user, name, ok := userCollection(c)
+	if !ok {
+		return
+	}
+	if err := user.DeleteCollection(c.Param("collection")); err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"collection": map[string]string{
+			"uuid": c.Param("collection"),
+			"name": name,
+		},
+	})
+}
+
+// AddGist - Add a gist to a collection
+func (r CollectionResource) AddGist(c *gin.Context) {
+	_, name, ok := userCollection(c)
+	if !ok {
+		return
+	}
+	gist, ok := existingGist(c)
+	if !ok {
+		return
+	}
+	if err := models.AddToCollection(c.Param("collection"), gist.UUID); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondCollection(c, c.Param("collection"), name)
+}
+
+// RemoveGist - Remove a gist from a collection
+func (r CollectionResource) RemoveGist(c *gin.Context) {
+	_, name, ok := userCollection(c)
+	if !ok {
+		return
+	}
+	gist, ok := gistParam(c)
+	if !ok {
+		return
+	}
+	if err := models.RemoveFromCollection(c.Param("collection"), gist.UUID); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondCollection(c, c.Param("collection"), name)
+}
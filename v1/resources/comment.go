@@ -0,0 +1,176 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+)
+
+// CommentResource - Comments on gists
+type CommentResource struct {
+	Engine *gin.RouterGroup
+}
+
+type rawComment struct {
+	Body      string `json:"body" form:"body"`
+	Snippet   string `json:"snippet" form:"snippet"`
+	LineStart int    `json:"line_start" form:"line_start"`
+	LineEnd   int    `json:"line_end" form:"line_end"`
+}
+
+// Routes - Setup comment routes
+func (r CommentResource) Routes() {
+	r.Engine.GET("/gists/:uuid/comments", r.List)
+	r.Engine.POST("/gists/:uuid/comments", r.Create)
+	r.Engine.DELETE("/gists/:uuid/comments/:comment", r.Delete)
+}
+
+func countLines(paste string) int {
+	return len(strings.Split(strings.TrimSuffix(paste, "\n"), "\n"))
+}
+
+// List - Comments of a gist ordered by creation
+func (r CommentResource) List(c *gin.Context) {
+	gist, ok := existingGist(c)
+	if !ok {
+		return
+	}
+	all, err := gist.GetComments()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	comments := []map[string]string{}
+	for _, comment := range all {
+		if c.Query("snippet") == "" || c.Query("snippet") == comment["snippet"] {
+			comments = append(comments, comment)
+		}
+	}
+	c.JSON(200, gin.H{
+		"comments": comments,
+	})
+}
+
+/*
+Create - Comment a gist, optionally anchored to a snippet and line range.
+
+	# curl $API/gists/<uuid>/comments -H 'Authorization: Token <userid>' \
+		-d 'body=Typo' -d 'snippet=<snippet>' -d 'line_start=3' -d 'line_end=4'
+	{
+		"comment": {
+			"uuid": <UUID>,
+			"gist": <gist>,
+			"author": <userid>,
+			"body": "Typo",
+			"snippet": <snippet>,
+			"line_start": "3",
+			"line_end": "4",
+			"created_at": "2016-05-01T10:00:00Z"
+		}
+	}
+*/
+func (r CommentResource) Create(c *gin.Context) {
+	user, authenticated := currentUser(c)
+	if !authenticated {
+		return
+	}
+	gist, ok := existingGist(c)
+	if !ok {
+		return
+	}
+	var raw rawComment
+	if !bind(c, &raw) {
+		return
+	}
+	if strings.TrimSpace(raw.Body) == "" {
+		Unprocessable(c, "Comment body must not be empty", nil)
+		return
+	}
+	comment := map[string]string{
+		"author": user.UUID,
+		"body":   raw.Body,
+	}
+	if raw.Snippet != "" {
+		snippet, found, err := gist.GetSnippet(raw.Snippet)
+		if err != nil {
+			InternalError(c, err)
+			return
+		} else if !found {
+			NotFound("Snippet", c)
+			return
+		}
+		comment["snippet"] = raw.Snippet
+		if raw.LineStart != 0 || raw.LineEnd != 0 {
+			if raw.LineEnd == 0 {
+				raw.LineEnd = raw.LineStart
+			}
+			if raw.LineStart < 1 || raw.LineEnd < raw.LineStart || raw.LineEnd > countLines(snippet["paste"]) {
+				Unprocessable(c, "Line range is outside of the snippet", nil)
+				return
+			}
+			comment["line_start"] = strconv.Itoa(raw.LineStart)
+			comment["line_end"] = strconv.Itoa(raw.LineEnd)
+		}
+	} else if raw.LineStart != 0 || raw.LineEnd != 0 {
+		Unprocessable(c, "Line ranges require a snippet", nil)
+		return
+	}
+	comment, err := gist.AddComment(comment)
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(201, gin.H{
+		"comment": comment,
+	})
+}
+
+// Delete - Remove a comment. Allowed for its author and the gist owner.
+func (r CommentResource) Delete(c *gin.Context) {
+	user, authenticated := currentUser(c)
+	if !authenticated {
+		return
+	}
+	gist, ok := gistParam(c)
+	if !ok {
+		return
+	}
+	comment, found, err := gist.GetComment(c.Param("comment"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	} else if !found {
+		NotFound("Comment", c)
+		return
+	}
+	owned, err := gist.OwnedBy(user.UUID)
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	if comment["author"] != user.UUID && !owned {
+		Abort(c, 403, "forbidden", "Only the author or the gist owner may delete comments", nil)
+		return
+	}
+	if err := gist.DeleteComment(c.Param("comment")); err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"comment": comment,
+	})
+}
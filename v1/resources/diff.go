@@ -0,0 +1,109 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/helper"
+)
+
+// DiffResource - Comparing snippets of gists
+type DiffResource struct {
+	Engine *gin.RouterGroup
+}
+
+// Routes - Setup diff routes
+func (d DiffResource) Routes() {
+	d.Engine.GET("/gists/:uuid/diff", d.Get)
+	d.Engine.GET("/gists/:uuid/diff/:other", d.Get)
+}
+
+/*
+Get - Diff two snippets. Both snippets are looked up in the gist,
+unless a second gist is given, which then contains the "to" snippet.
+
+	# curl "$API/gists/<uuid>/diff?from=<snippet>&to=<snippet>"
+	{
+		"diff": {
+			"from": { "gist": <uuid>, "snippet": <snippet> },
+			"to": { "gist": <uuid>, "snippet": <snippet> },
+			"hunks": [
+				{ "from_start": 1, "from_lines": 2, "to_start": 1, "to_lines": 2,
+				  "lines": [ { "op": "-", "text": "moo" }, ... ] }
+			],
+			"unified": "--- ...\n+++ ...\n@@ -1,2 +1,2 @@\n..."
+		}
+	}
+
+	# curl "$API/gists/<uuid>/diff/<other uuid>?from=<snippet>&to=<snippet>&format=text"
+	--- <uuid>/<snippet>
+	+++ <other uuid>/<snippet>
+	...
+*/
+func (d DiffResource) Get(c *gin.Context) {
+	from, ok := gistParam(c)
+	if !ok {
+		return
+	}
+	to := from
+	if c.Param("other") != "" {
+		if to, ok = resolveGist(c, c.Param("other")); !ok {
+			return
+		}
+	}
+	if c.Query("from") == "" || c.Query("to") == "" {
+		Abort(c, 400, "bad_request", "from and to snippets are required", nil)
+		return
+	}
+	fromSnippet, found, err := from.GetSnippet(c.Query("from"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	} else if !found {
+		NotFound("Snippet", c)
+		return
+	}
+	toSnippet, found, err := to.GetSnippet(c.Query("to"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	} else if !found {
+		NotFound("Snippet", c)
+		return
+	}
+
+	fromName := from.UUID + "/" + c.Query("from")
+	toName := to.UUID + "/" + c.Query("to")
+	hunks := helper.Diff(fromSnippet["paste"], toSnippet["paste"], 3)
+	unified := helper.UnifiedDiff(fromName, toName, hunks)
+	if c.Query("format") == "text" {
+		c.Data(200, "text/x-diff; charset=utf-8", []byte(unified))
+		return
+	}
+	c.JSON(200, gin.H{
+		"diff": gin.H{
+			"from": map[string]string{
+				"gist":    from.UUID,
+				"snippet": c.Query("from"),
+			},
+			"to": map[string]string{
+				"gist":    to.UUID,
+				"snippet": c.Query("to"),
+			},
+			"hunks":   hunks,
+			"unified": unified,
+		},
+	})
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/muhproductions/muh/helper"
+	"html"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const embedStyle = `<style>` +
+	`.muh-gist{font:12px/1.5 monospace;border:1px solid #ddd;border-radius:3px;margin:1em 0}` +
+	`.muh-meta{background:#f7f7f7;border-bottom:1px solid #ddd;padding:4px 8px;color:#666}` +
+	`.muh-gist pre{margin:0;padding:8px;overflow:auto}` +
+	`.muh-comment{color:#998;font-style:italic}.muh-string{color:#d14}` +
+	`.muh-number{color:#099}.muh-keyword{color:#333;font-weight:bold}` +
+	`</style>`
+
+var gistURL = regexp.MustCompile(`/gists/([^/?#]+)`)
+
+// hostFormat matches hosts with an optional port, which are safe to
+// build urls of.
+var hostFormat = regexp.MustCompile(`^([A-Za-z0-9.-]+|\[[0-9A-Fa-f:.]+\])(:[0-9]+)?$`)
+
+// EmbedResource - Embedding gists into other pages
+type EmbedResource struct {
+	Engine *gin.RouterGroup
+	Root   *gin.RouterGroup
+}
+
+// Routes - Setup embed routes
+func (e EmbedResource) Routes() {
+	e.Engine.GET("/gists/:uuid/embed.js", e.Script)
+	e.Root.GET("/oembed", e.OEmbed)
+}
+
+// baseURL returns BASE_URL, or the url the request was sent to if it
+// is unset. ok is false for requests with an invalid Host header.
+func baseURL(c *gin.Context) (string, bool) {
+	if os.Getenv("BASE_URL") != "" {
+		return strings.TrimRight(os.Getenv("BASE_URL"), "/"), true
+	}
+	if !hostFormat.MatchString(c.Request.Host) {
+		return "", false
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.Request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host, true
+}
+
+func sortedSnippets(snippets map[string]map[string]string) []string {
+	ids := []string{}
+	for id := range snippets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/*
+Script - Javascript widget, which writes the highlighted snippets
+of a gist into the embedding page.
+
+	<script src="$API/v1/gists/<uuid>/embed.js"></script>
+*/
+func (e EmbedResource) Script(c *gin.Context) {
+	gist, ok := existingGist(c)
+	if !ok {
+		return
+	}
+	snippets, err := gist.GetSnippets()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	var out bytes.Buffer
+	out.WriteString(embedStyle)
+	out.WriteString(`<div class="muh-gist">`)
+	for _, id := range sortedSnippets(snippets) {
+		snippet := snippets[id]
+		title := snippet["filename"]
+		if title == "" {
+			title = snippet["lang"]
+		}
+		out.WriteString(`<div class="muh-meta">` + html.EscapeString(title) + `</div>`)
+		out.WriteString(`<pre><code class="language-` + html.EscapeString(snippet["lang"]) + `">`)
+		out.WriteString(helper.Highlight(snippet["lang"], snippet["paste"]))
+		out.WriteString(`</code></pre>`)
+	}
+	out.WriteString(`</div>`)
+	encoded, _ := json.Marshal(out.String())
+	c.Data(200, "application/javascript; charset=utf-8", []byte("document.write("+string(encoded)+");\n"))
+}
+
+/*
+OEmbed - oEmbed provider endpoint for gist urls.
+
+	# curl $API/oembed?url=$API/v1/gists/<uuid>
+	{
+		"version": "1.0",
+		"type": "rich",
+		"html": "<script src=...></script>",
+		...
+	}
+*/
+func (e EmbedResource) OEmbed(c *gin.Context) {
+	if format := c.Query("format"); format != "" && format != "json" {
+		Abort(c, 501, "not_implemented", "Format "+format+" not supported", nil)
+		return
+	}
+	target, err := url.Parse(c.Query("url"))
+	if err != nil || !gistURL.MatchString(target.Path) {
+		NotFound("Gist", c)
+		return
+	}
+	gist, ok := findGist(c, gistURL.FindStringSubmatch(target.Path)[1])
+	if !ok {
+		return
+	}
+	snippets, err := gist.GetSnippets()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	lines := 0
+	for _, snippet := range snippets {
+		lines += strings.Count(snippet["paste"], "\n") + 2
+	}
+	width, height := 600, lines*18+20
+	if max, err := strconv.Atoi(c.Query("maxwidth")); err == nil && max < width {
+		width = max
+	}
+	if max, err := strconv.Atoi(c.Query("maxheight")); err == nil && max < height {
+		height = max
+	}
+	base, ok := baseURL(c)
+	if !ok {
+		Abort(c, 400, "bad_request", "Invalid Host header", nil)
+		return
+	}
+	src := base + "/v1/gists/" + url.PathEscape(gist.UUID) + "/embed.js"
+	c.JSON(200, gin.H{
+		"version":       "1.0",
+		"type":          "rich",
+		"title":         html.EscapeString("Gist " + gist.UUID),
+		"provider_name": "muh",
+		"provider_url":  base,
+		"html":          `<script src="` + html.EscapeString(src) + `"></script>`,
+		"width":         width,
+		"height":        height,
+	})
+}
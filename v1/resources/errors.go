@@ -15,19 +15,89 @@
 package resources
 
 import (
+	log "github.com/Sirupsen/logrus"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
+// RequestIDKey - Context key of the request id
+const RequestIDKey = "request_id"
+
+/*
+Error - Error response used by all endpoints
+
+	{
+		"code": "not_found",
+		"message": "Gist not found",
+		"details": null,
+		"request_id": "4c0f2a6e-..."
+	}
+*/
+type Error struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details"`
+	RequestID string      `json:"request_id"`
+}
+
+// Abort - Respond with an error and stop the handler chain
+func Abort(c *gin.Context, status int, code string, message string, details interface{}) {
+	id, _ := c.Get(RequestIDKey)
+	requestID, _ := id.(string)
+	c.JSON(status, Error{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: requestID,
+	})
+	c.Abort()
+}
+
 // NotFound - Generic resource 404
 func NotFound(resource string, c *gin.Context) {
-	c.JSON(404, gin.H{
-		"message": resource + " not found",
-	})
+	Abort(c, 404, "not_found", resource+" not found", nil)
 }
 
-// InternalError - Generic error
-func InternalError(c *gin.Context) {
-	c.JSON(422, gin.H{
-		"message": "Internal error occured.",
-	})
+// InternalError - Generic error, the cause is logged only
+func InternalError(c *gin.Context, err error) {
+	id, _ := c.Get(RequestIDKey)
+	log.WithFields(log.Fields{
+		"request_id": id,
+		"path":       c.Request.URL.Path,
+	}).Error(err)
+	Abort(c, 500, "internal_error", "Internal error occured.", nil)
+}
+
+// BadRequest - Request couldn't be parsed
+func BadRequest(c *gin.Context, err error) {
+	Abort(c, 400, "bad_request", "Invalid request", err.Error())
+}
+
+// Unauthorized - Authentication is required
+func Unauthorized(c *gin.Context) {
+	Abort(c, 401, "unauthorized", "Authentication required", nil)
+}
+
+// Unprocessable - Request is well-formed, but invalid
+func Unprocessable(c *gin.Context, message string, details interface{}) {
+	Abort(c, 422, "unprocessable", message, details)
+}
+
+// bind decodes the request body by its content type.
+func bind(c *gin.Context, obj interface{}) bool {
+	return bindWith(c, obj, binding.Default(c.Request.Method, c.ContentType()))
+}
+
+// bindWith decodes the request body and responds with 400 on errors.
+func bindWith(c *gin.Context, obj interface{}, b binding.Binding) bool {
+	if err := b.Bind(c.Request, obj); err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			bodyTooLarge(c, maxBodyBytes())
+		} else {
+			BadRequest(c, err)
+		}
+		return false
+	}
+	return true
 }
@@ -15,9 +15,12 @@
 package resources
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/muhproductions/muh/helper"
 	"github.com/muhproductions/muh/v1/models"
+	"strconv"
 	"strings"
 )
 
@@ -29,34 +32,300 @@ type GistResource struct {
 // Routes - Setup gists resource routes
 func (g GistResource) Routes() {
 	g.Engine.GET("/gists/:uuid", g.Get)
+	g.Engine.GET("/gists/:uuid/snippets/:snippet/raw", g.Raw)
 	g.Engine.POST("/gists/:uuid", g.CreateSnippets)
 	g.Engine.POST("/gists", g.CreateSnippets)
+	g.Engine.PUT("/users/:userid/gists/:uuid/slug", g.SetSlug)
+	g.Engine.DELETE("/users/:userid/gists/:uuid/slug", g.RemoveSlug)
+	g.Engine.PUT("/users/:userid/gists/:uuid/pin", g.Pin)
+	g.Engine.DELETE("/users/:userid/gists/:uuid/pin", g.Unpin)
+	g.Engine.DELETE("/users/:userid/gists/:uuid/snippets/:snippet", g.DeleteSnippet)
 
-	helper.Callbacks = append(helper.Callbacks, storeInBolt)
+	helper.Callbacks = append(helper.Callbacks, offloadExpired)
 }
 
-func storeInBolt(payload string) {
-	key := strings.Replace(payload, "shadow::", "", -1)
-	value := helper.RedisClient().Get(key).Val()
-	helper.BoltSet(key, value)
-	helper.RedisClient().Del(key)
+// offloadExpired moves a value into cold storage once its shadow key expired.
+func offloadExpired(payload string) {
+	if !strings.HasPrefix(payload, "shadow::") {
+		return
+	}
+	key := strings.TrimPrefix(payload, "shadow::")
+	if err := models.Offload(key); err != nil {
+		log.Error(err, "Offloading "+key+" failed, keeping it in redis")
+	}
+}
+
+// gistParam resolves the :uuid parameter, which might also be
+// a short id or a slug.
+func gistParam(c *gin.Context) (models.Gist, bool) {
+	return resolveGist(c, c.Param("uuid"))
+}
+
+func resolveGist(c *gin.Context, id string) (models.Gist, bool) {
+	gist, err := models.ResolveGist(id)
+	if err != nil {
+		InternalError(c, err)
+		return gist, false
+	}
+	return gist, true
+}
+
+// existingGist resolves the :uuid parameter and responds with 404
+// unless the gist exists.
+func existingGist(c *gin.Context) (models.Gist, bool) {
+	return findGist(c, c.Param("uuid"))
+}
+
+func findGist(c *gin.Context, id string) (models.Gist, bool) {
+	gist, ok := resolveGist(c, id)
+	if !ok {
+		return gist, false
+	}
+	exists, err := gist.Exists()
+	if err != nil {
+		InternalError(c, err)
+		return gist, false
+	}
+	if !exists {
+		NotFound("Gist", c)
+		return gist, false
+	}
+	return gist, true
+}
+
+// ownedGist resolves the :uuid parameter and responds with 404 unless
+// the gist is owned by :userid.
+func ownedGist(c *gin.Context) (models.Gist, bool) {
+	gist, ok := gistParam(c)
+	if !ok {
+		return gist, false
+	}
+	owned, err := gist.OwnedBy(c.Param("userid"))
+	if err != nil {
+		InternalError(c, err)
+		return gist, false
+	}
+	if !owned {
+		NotFound("Gist", c)
+		return gist, false
+	}
+	return gist, true
+}
+
+func gistInfo(c *gin.Context, gist models.Gist) (map[string]string, bool) {
+	info := map[string]string{
+		"uuid": gist.UUID,
+	}
+	slug, err := gist.Slug()
+	if err != nil {
+		InternalError(c, err)
+		return nil, false
+	}
+	if slug != "" {
+		info["slug"] = slug
+	}
+	return info, true
 }
 
 // Get - gist by id
 func (g GistResource) Get(c *gin.Context) {
-	gist := models.Gist{
-		UUID: c.Param("uuid"),
+	gist, ok := existingGist(c)
+	if !ok {
+		return
 	}
-	if gist.Exists() == false {
-		NotFound("Gist", c)
-	} else {
-		c.JSON(200, gin.H{
-			"gist": map[string]string{
-				"uuid": gist.UUID,
-			},
-			"snippets": gist.GetSnippets(),
-		})
+	snippets, err := gist.GetSnippets()
+	if err != nil {
+		InternalError(c, err)
+		return
 	}
+	info, ok := gistInfo(c, gist)
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{
+		"gist":     info,
+		"snippets": snippets,
+	})
+}
+
+type rawSlug struct {
+	Slug string `json:"slug" form:"slug" binding:"required"`
+}
+
+/*
+SetSlug - Assign a vanity slug to an owned gist.
+
+	# curl -X PUT $API/users/<userid>/gists/<uuid>/slug -d 'slug=my-config'
+	{
+		"gist": {
+			"uuid": <UUID>,
+			"slug": "my-config"
+		}
+	}
+*/
+func (g GistResource) SetSlug(c *gin.Context) {
+	gist, ok := ownedGist(c)
+	if !ok {
+		return
+	}
+	var raw rawSlug
+	if !bind(c, &raw) {
+		return
+	}
+	switch err := gist.SetSlug(raw.Slug); err {
+	case nil:
+		if info, ok := gistInfo(c, gist); ok {
+			c.JSON(200, gin.H{
+				"gist": info,
+			})
+		}
+	case models.ErrSlugTaken:
+		Abort(c, 409, "conflict", err.Error(), nil)
+	case models.ErrSlugInvalid:
+		Unprocessable(c, err.Error(), nil)
+	default:
+		InternalError(c, err)
+	}
+}
+
+// RemoveSlug - Release the vanity slug of an owned gist.
+func (g GistResource) RemoveSlug(c *gin.Context) {
+	gist, ok := ownedGist(c)
+	if !ok {
+		return
+	}
+	if err := gist.RemoveSlug(); err != nil {
+		InternalError(c, err)
+		return
+	}
+	info, ok := gistInfo(c, gist)
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{
+		"gist": info,
+	})
+}
+
+/*
+Raw - Paste of a snippet as plain text. Pastes stored compressed by
+gzip or brotli are passed through to clients accepting that encoding.
+
+	# curl --compressed $API/gists/<uuid>/snippets/<snippet>/raw
+	puts 'moo'
+*/
+func (g GistResource) Raw(c *gin.Context) {
+	gist, ok := existingGist(c)
+	if !ok {
+		return
+	}
+	blob, stored, err := gist.GetPaste(c.Param("snippet"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	encoding, payload := helper.HTTPEncoding(blob)
+	if stored && encoding != "" && helper.AcceptsEncoding(c.Request.Header.Get("Accept-Encoding"), encoding) {
+		c.Header("Content-Encoding", encoding)
+		c.Header("Vary", "Accept-Encoding")
+		c.Data(200, "text/plain; charset=utf-8", []byte(payload))
+		return
+	}
+	snippet, found, err := gist.GetSnippet(c.Param("snippet"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	if !found {
+		NotFound("Snippet", c)
+		return
+	}
+	c.Data(200, "text/plain; charset=utf-8", []byte(snippet["paste"]))
+}
+
+/*
+Pin - Keep the snippets of an owned gist in redis, regardless of the
+tiering policy.
+
+	# curl -X PUT $API/users/<userid>/gists/<uuid>/pin
+	{
+		"gist": {
+			"uuid": <UUID>
+		},
+		"pinned": true
+	}
+*/
+func (g GistResource) Pin(c *gin.Context) {
+	gist, ok := ownedGist(c)
+	if !ok {
+		return
+	}
+	if err := gist.Pin(); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondPinned(c, gist, true)
+}
+
+// Unpin - Hand the snippets of an owned gist back to the tiering policy.
+func (g GistResource) Unpin(c *gin.Context) {
+	gist, ok := ownedGist(c)
+	if !ok {
+		return
+	}
+	if err := gist.Unpin(); err != nil {
+		InternalError(c, err)
+		return
+	}
+	respondPinned(c, gist, false)
+}
+
+func respondPinned(c *gin.Context, gist models.Gist, pinned bool) {
+	info, ok := gistInfo(c, gist)
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{
+		"gist":   info,
+		"pinned": pinned,
+	})
+}
+
+/*
+DeleteSnippet - Remove a snippet of an owned gist. Its paste is freed
+once no other snippet shares the same content.
+
+	# curl -X DELETE $API/users/<userid>/gists/<uuid>/snippets/<snippet>
+	{
+		"snippet": {
+			"hash": <SHA-256>,
+			"lang": "ruby",
+			"paste": "puts 'moo'"
+		}
+	}
+*/
+func (g GistResource) DeleteSnippet(c *gin.Context) {
+	gist, ok := ownedGist(c)
+	if !ok {
+		return
+	}
+	snippet, found, err := gist.GetSnippet(c.Param("snippet"))
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	if !found {
+		NotFound("Snippet", c)
+		return
+	}
+	if err := gist.DeleteSnippet(c.Param("snippet")); err != nil {
+		InternalError(c, err)
+		return
+	}
+	releaseStorage(c, []rawSnippet{{Paste: snippet["paste"]}})
+	c.JSON(200, gin.H{
+		"snippet": snippet,
+	})
 }
 
 type rawGist struct {
@@ -64,36 +333,137 @@ type rawGist struct {
 }
 
 type rawSnippet struct {
-	Paste string `json:"paste"`
-	Lang  string `json:"lang"`
+	Paste    string `json:"paste"`
+	Lang     string `json:"lang"`
+	Filename string `json:"filename"`
 }
 
-// CreateSnippets - Create or add new Snippets
+// value converts the raw snippet into its stored representation.
+// The language is detected unless the client provided one.
+func (s rawSnippet) value() map[string]string {
+	v := map[string]string{
+		"paste": s.Paste,
+		"lang":  s.Lang,
+	}
+	if s.Filename != "" {
+		v["filename"] = s.Filename
+	}
+	if s.Lang == "" {
+		lang, confidence := helper.DetectLanguage(s.Filename, s.Paste)
+		v["lang"] = lang
+		v["lang_confidence"] = strconv.FormatFloat(confidence, 'f', 2, 64)
+	}
+	return v
+}
+
+/*
+CreateSnippets - Create or add new Snippets. The body is limited to
+MAX_BODY_BYTES, snippets are validated against MAX_SNIPPETS,
+MAX_SNIPPET_BYTES and ALLOWED_LANGS.
+
+	# curl $API/gists -d '{"snippets": [{"paste": ""}]}'
+	=> HTTP 422
+	{
+		"code": "validation_failed",
+		"message": "Validation failed",
+		"details": [
+			{ "field": "snippets[0].paste", "message": "must not be empty" }
+		],
+		"request_id": <ID>
+	}
+*/
 func (g GistResource) CreateSnippets(c *gin.Context) {
 	gist := models.Gist{}
 	if c.Param("uuid") != "" {
-		gist.UUID = c.Param("uuid")
+		var ok bool
+		if gist, ok = gistParam(c); !ok {
+			return
+		}
+	}
+	if !limitBody(c) {
+		return
 	}
 	var rawgist rawGist
 	snippets := []map[string]string{}
-	if c.BindJSON(&rawgist) == nil {
-		for _, snip := range rawgist.Snippets {
-			snippets = append(snippets, map[string]string{
-				"paste": snip.Paste,
-				"lang":  snip.Lang,
-			})
-		}
-	} else {
+	if !bindWith(c, &rawgist, binding.JSON) {
 		return
 	}
-	if len(snippets) > 0 {
-		gist.AddSnippets(snippets, c.Param("userid"))
+	if len(rawgist.Snippets) > 0 {
+		var existing int64
+		if gist.UUID != "" {
+			var err error
+			if existing, err = gist.SnippetCount(); err != nil {
+				InternalError(c, err)
+				return
+			}
+		}
+		if errors := validateSnippets(rawgist.Snippets, existing); len(errors) > 0 {
+			validationFailed(c, errors)
+			return
+		}
+		if !reserveStorage(c, rawgist.Snippets) {
+			return
+		}
+		for _, snip := range rawgist.Snippets {
+			snippets = append(snippets, snip.value())
+		}
+		if err := gist.AddSnippets(snippets, c.Param("userid")); err != nil {
+			releaseStorage(c, rawgist.Snippets)
+			InternalError(c, err)
+			return
+		}
 		c.JSON(201, gin.H{
 			"gist": map[string]string{
 				"uuid": gist.UUID,
 			},
 		})
 	} else {
-		c.AbortWithStatus(400)
+		Abort(c, 400, "bad_request", "At least one snippet is required", nil)
+	}
+}
+
+// reserveStorage accounts the paste bytes to the user creating
+// the snippets and rejects them once the storage quota is exceeded.
+func reserveStorage(c *gin.Context, snippets []rawSnippet) bool {
+	if c.Param("userid") == "" {
+		return true
+	}
+	user := models.User{UUID: c.Param("userid")}
+	switch err := user.ReserveStorage(pasteSize(snippets)); err {
+	case nil:
+		return true
+	case models.ErrStorageQuota:
+		used, usedErr := user.StorageUsed()
+		if usedErr != nil {
+			InternalError(c, usedErr)
+			return false
+		}
+		Abort(c, 507, "quota_exceeded", err.Error(), gin.H{
+			"used":  used,
+			"quota": models.StorageQuota(),
+		})
+	default:
+		InternalError(c, err)
+	}
+	return false
+}
+
+// releaseStorage returns reserved bytes of snippets, which couldn't be
+// stored or were deleted.
+func releaseStorage(c *gin.Context, snippets []rawSnippet) {
+	if c.Param("userid") == "" {
+		return
+	}
+	user := models.User{UUID: c.Param("userid")}
+	if err := user.ReleaseStorage(pasteSize(snippets)); err != nil {
+		log.Error(err, "Releasing storage failed")
+	}
+}
+
+func pasteSize(snippets []rawSnippet) int64 {
+	var size int64
+	for _, snip := range snippets {
+		size += int64(len(snip.Paste))
 	}
+	return size
 }
@@ -0,0 +1,164 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errBodyTooLarge is returned by reads of a body beyond MAX_BODY_BYTES.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reads beyond its remaining bytes by errBodyTooLarge.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n, b.remaining = int(b.remaining), -1
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// FieldError - Validation error of a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// envLimit returns a limit configured by the environment,
+// 0 means unlimited.
+func envLimit(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		return fallback
+	}
+	return limit
+}
+
+// maxBodyBytes is set by MAX_BODY_BYTES, defaults to 1 MiB.
+func maxBodyBytes() int64 {
+	return envLimit("MAX_BODY_BYTES", 1<<20)
+}
+
+// maxSnippets is the amount of snippets per gist set by MAX_SNIPPETS.
+func maxSnippets() int64 {
+	return envLimit("MAX_SNIPPETS", 0)
+}
+
+// maxSnippetBytes is the size of a paste set by MAX_SNIPPET_BYTES.
+func maxSnippetBytes() int64 {
+	return envLimit("MAX_SNIPPET_BYTES", 0)
+}
+
+// allowedLangs returns the languages listed in ALLOWED_LANGS,
+// an empty list allows any language.
+func allowedLangs() []string {
+	langs := []string{}
+	for _, lang := range strings.Split(os.Getenv("ALLOWED_LANGS"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// limitBody rejects requests announcing a body larger than
+// MAX_BODY_BYTES and limits reading the body otherwise.
+func limitBody(c *gin.Context) bool {
+	max := maxBodyBytes()
+	if max == 0 {
+		return true
+	}
+	if c.Request.ContentLength > max {
+		bodyTooLarge(c, max)
+		return false
+	}
+	c.Request.Body = &limitedBody{ReadCloser: c.Request.Body, remaining: max}
+	return true
+}
+
+func bodyTooLarge(c *gin.Context, max int64) {
+	Abort(c, 413, "body_too_large", "Request body exceeds "+strconv.FormatInt(max, 10)+" bytes", nil)
+}
+
+// validationFailed responds with the field errors of a request.
+func validationFailed(c *gin.Context, errors []FieldError) {
+	Abort(c, 422, "validation_failed", "Validation failed", errors)
+}
+
+// validateSnippets verifies snippets against the configured limits.
+// existing is the amount of snippets the gist already has.
+func validateSnippets(snippets []rawSnippet, existing int64) []FieldError {
+	errors := []FieldError{}
+	if max := maxSnippets(); max > 0 && existing+int64(len(snippets)) > max {
+		errors = append(errors, FieldError{
+			Field:   "snippets",
+			Message: "a gist must not have more than " + strconv.FormatInt(max, 10) + " snippets",
+		})
+	}
+	langs := allowedLangs()
+	for i, snip := range snippets {
+		field := "snippets[" + strconv.Itoa(i) + "]"
+		if strings.TrimSpace(snip.Paste) == "" {
+			errors = append(errors, FieldError{
+				Field:   field + ".paste",
+				Message: "must not be empty",
+			})
+		}
+		if max := maxSnippetBytes(); max > 0 && int64(len(snip.Paste)) > max {
+			errors = append(errors, FieldError{
+				Field:   field + ".paste",
+				Message: "must not exceed " + strconv.FormatInt(max, 10) + " bytes",
+			})
+		}
+		if snip.Lang != "" && len(langs) > 0 && !contains(langs, snip.Lang) {
+			errors = append(errors, FieldError{
+				Field:   field + ".lang",
+				Message: "must be one of " + strings.Join(langs, ", "),
+			})
+		}
+	}
+	return errors
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
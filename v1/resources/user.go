@@ -16,6 +16,7 @@ package resources
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/muhproductions/muh/v1/models"
 )
 
@@ -39,31 +40,53 @@ func (u UserResource) Routes() {
 	u.Engine.POST("/users", u.Create)
 }
 
+// checkUserExists loads the user of the userid param. It responds with
+// 404 for unknown users and 500 on errors.
 func checkUserExists(c *gin.Context) models.User {
 	user := models.User{
 		UUID: c.Param("userid"),
 	}
-	if user.GetUsername() == "" {
+	username, err := user.GetUsername()
+	if err != nil {
+		InternalError(c, err)
+	} else if username == "" {
 		NotFound("User", c)
-		c.AbortWithStatus(404)
 	}
 	return user
 }
 
+// bindLogin decodes form or json credentials.
+func bindLogin(c *gin.Context, login *Login) bool {
+	if c.PostForm("username") == "" {
+		return bindWith(c, login, binding.JSON)
+	}
+	return bindWith(c, login, binding.Form)
+}
+
 //Authorize - authorize users by json response
 func (u UserResource) Authorize(c *gin.Context) {
 	var login Login
-	if (c.PostForm("username") == "" && c.BindJSON(&login) == nil) || c.Bind(&login) == nil {
+	if bindLogin(c, &login) {
 		user := models.User{Username: login.Username}
-		if user.EqualsPassword(login.Password) {
+		equals, err := user.EqualsPassword(login.Password)
+		if err != nil {
+			InternalError(c, err)
+			return
+		}
+		if equals {
+			id, err := user.GetUUID()
+			if err != nil {
+				InternalError(c, err)
+				return
+			}
 			c.JSON(200, gin.H{
 				"user": map[string]string{
-					"uuid": user.GetUUID(),
+					"uuid": id,
 				},
 			})
 			return
 		}
-		c.AbortWithStatus(403)
+		Abort(c, 403, "forbidden", "Invalid username or password", nil)
 	}
 }
 
@@ -79,14 +102,42 @@ Get - Fetch user by id
 */
 func (u UserResource) Get(c *gin.Context) {
 	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	used, err := user.StorageUsed()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	created, err := user.CreatedGists()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	marked, err := user.MarkedGists()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
+	tags, err := user.Tags()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
 	c.JSON(200, gin.H{
 		"user": map[string]string{
-			"uuid":     user.GetUUID(),
-			"username": user.GetUsername(),
+			"uuid":     user.UUID,
+			"username": user.Username,
 		},
 		"gists": map[string][]string{
-			"created": user.CreatedGists(),
-			"marked":  user.MarkedGists(),
+			"created": created,
+			"marked":  marked,
+		},
+		"tags": tags,
+		"storage": map[string]int64{
+			"used":  used,
+			"quota": models.StorageQuota(),
 		},
 	})
 }
@@ -103,35 +154,39 @@ Create - User by username and password
 	}
 
 	# curl $API/users -d 'username=moo' -d 'password=swordfish'
-	=> HTTP 405
+	=> HTTP 409
 	{
-		"message": "User already available"
+		"code": "conflict",
+		"message": "User already available",
+		"details": null,
+		"request_id": <ID>
 	}
 */
 func (u UserResource) Create(c *gin.Context) {
 	var login Login
-	err := c.PostForm("username") == "" && c.BindJSON(&login) == nil || c.Bind(&login) == nil
-	if !err {
-		c.AbortWithStatus(400)
+	if !bindLogin(c, &login) {
 		return
 	}
 	newuser := models.NewUser(login.Username, login.Password)
-	if newuser.Available() {
-		c.AbortWithStatus(405)
+	available, err := newuser.Available()
+	if err != nil {
+		InternalError(c, err)
 		return
 	}
-	if newuser.Save() {
-		c.JSON(201, gin.H{
-			"user": map[string]string{
-				"uuid":     newuser.UUID,
-				"username": newuser.Username,
-			},
-		})
-	} else {
-		c.JSON(422, gin.H{
-			"message": "Createing new user failed.",
-		})
+	if available {
+		Abort(c, 409, "conflict", "User already available", nil)
+		return
 	}
+	if err := newuser.Save(); err != nil {
+		InternalError(c, err)
+		return
+	}
+	c.JSON(201, gin.H{
+		"user": map[string]string{
+			"uuid":     newuser.UUID,
+			"username": newuser.Username,
+		},
+	})
 }
 
 /*
@@ -147,10 +202,18 @@ ResetUUID - reset users uuid.
 */
 func (u UserResource) ResetUUID(c *gin.Context) {
 	user := checkUserExists(c)
+	if c.IsAborted() {
+		return
+	}
+	id, err := user.ResetUUID()
+	if err != nil {
+		InternalError(c, err)
+		return
+	}
 	c.JSON(200, gin.H{
 		"user": map[string]string{
-			"uuid":     user.ResetUUID(),
-			"username": user.GetUsername(),
+			"uuid":     id,
+			"username": user.Username,
 		},
 	})
 }
@@ -0,0 +1,198 @@
+// Copyright 2016 Tim Foerster <github@mailserver.1n3t.de>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/muhproductions/muh/helper"
+	"github.com/muhproductions/muh/v1/models"
+	"gopkg.in/redis.v3"
+	"os"
+	"strings"
+	"time"
+)
+
+// hasExpiredEvents checks whether notify-keyspace-events flags
+// publish expired events on the keyevent channel.
+func hasExpiredEvents(flags string) bool {
+	return strings.Contains(flags, "E") &&
+		(strings.Contains(flags, "x") || strings.Contains(flags, "A"))
+}
+
+// notificationFlags returns the current notify-keyspace-events setting.
+func notificationFlags(r *redis.Client) (string, error) {
+	values, err := r.ConfigGet("notify-keyspace-events").Result()
+	if err != nil {
+		return "", err
+	}
+	if len(values) < 2 {
+		return "", nil
+	}
+	flags, _ := values[1].(string)
+	return flags, nil
+}
+
+// ensureNotifications verifies that redis publishes expired events,
+// which trigger the offload into cold storage. Missing flags are set
+// if REDIS_CONFIGURE_NOTIFICATIONS is "true".
+func ensureNotifications(r *redis.Client) bool {
+	flags, err := notificationFlags(r)
+	if err != nil {
+		log.Warn(err, "Reading notify-keyspace-events failed")
+		return false
+	}
+	if hasExpiredEvents(flags) {
+		return true
+	}
+	if os.Getenv("REDIS_CONFIGURE_NOTIFICATIONS") != "true" {
+		log.Warn("notify-keyspace-events lacks expired events (Ex), " +
+			"set it or REDIS_CONFIGURE_NOTIFICATIONS=true")
+		return false
+	}
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	if err := r.ConfigSet("notify-keyspace-events", flags+"x").Err(); err != nil {
+		log.Warn(err, "Setting notify-keyspace-events failed")
+		return false
+	}
+	log.Info("Enabled expired events by notify-keyspace-events=" + flags + "x")
+	return true
+}
+
+// sweepInterval returns how often the sweeper runs. It is set by
+// SWEEP_INTERVAL, without notifications it defaults to one minute.
+func sweepInterval(notifications bool) time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SWEEP_INTERVAL"))
+	if err == nil && interval > 0 {
+		return interval
+	}
+	if notifications {
+		return 0
+	}
+	return time.Minute
+}
+
+// Sweep offloads cached values whose shadow key already expired, as
+// the expired event would have done. It covers redis instances without
+// notifications and events missed while reconnecting.
+func Sweep(r *redis.Client) (int, error) {
+	swept := 0
+	for _, prefix := range models.CachedPrefixes {
+		var cursor int64
+		for {
+			next, keys, err := r.Scan(cursor, prefix+"*", 100).Result()
+			if err != nil {
+				return swept, err
+			}
+			for _, key := range keys {
+				cached, err := r.Exists("shadow::" + key).Result()
+				if err != nil {
+					return swept, err
+				}
+				if cached {
+					continue
+				}
+				for _, callback := range helper.Callbacks {
+					callback("shadow::" + key)
+				}
+				swept++
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return swept, nil
+}
+
+// offloadInterval returns how often queued keys are offloaded, set by
+// OFFLOAD_INTERVAL. Defaults to one minute.
+func offloadInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("OFFLOAD_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Minute
+	}
+	return interval
+}
+
+// offloadBatch limits the keys offloaded by a single OffloadDue.
+const offloadBatch = 1000
+
+// offloader works off the offload queue periodically. It catches keys
+// whose expired event got lost, e.g. while muh was down.
+func offloader(interval time.Duration) {
+	for range time.Tick(interval) {
+		done, errs := OffloadBacklog(offloadBatch)
+		for _, err := range errs {
+			log.Error(err, "Offloading queued value failed")
+		}
+		if done > 0 {
+			log.WithField("processed", done).Debug("Worked off offload queue")
+		}
+	}
+}
+
+// OffloadBacklog offloads due keys batch by batch, until a batch isn't
+// full anymore. A backlog, e.g. after an outage, is drained at once.
+func OffloadBacklog(batch int64) (int, []error) {
+	total := 0
+	var failed []error
+	for {
+		done, errs := models.OffloadDue(batch)
+		total += done
+		failed = append(failed, errs...)
+		if int64(done+len(errs)) < batch {
+			return total, failed
+		}
+	}
+}
+
+// rotationInterval returns how often requested key rotations are
+// checked, set by ROTATION_INTERVAL. Defaults to one minute.
+func rotationInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("ROTATION_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Minute
+	}
+	return interval
+}
+
+// rotator re-encrypts the bodies in the background, once "muh
+// rotate-keys" requested it.
+func rotator(interval time.Duration) {
+	for range time.Tick(interval) {
+		resealed, errs := models.RotateKeys()
+		for _, err := range errs {
+			log.Error(err, "Re-encrypting body failed")
+		}
+		if resealed > 0 {
+			log.WithField("resealed", resealed).Info("Re-encrypted bodies")
+		}
+	}
+}
+
+// sweeper runs Sweep periodically.
+func sweeper(r *redis.Client, interval time.Duration) {
+	for range time.Tick(interval) {
+		swept, err := Sweep(r)
+		if err != nil {
+			log.Error(err, "Sweeping cached values failed")
+		} else if swept > 0 {
+			log.WithField("swept", swept).Info("Offloaded cached values")
+		}
+	}
+}